@@ -2,16 +2,53 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/blockdaemon/chain_sink/pkg/adapters/kafka"
 	"github.com/blockdaemon/chain_sink/pkg/adapters/stdout"
+	"github.com/blockdaemon/chain_sink/pkg/circuitbreaker"
 	"github.com/blockdaemon/chain_sink/pkg/logger"
+	"github.com/blockdaemon/chain_sink/pkg/ratelimit"
 	"github.com/blockdaemon/chain_sink/pkg/stream"
 	"go.uber.org/zap"
 )
 
-func buildAdapter(ctx context.Context, cfg AdapterConfig) (stream.Adapter, error) {
+// buildAdapter builds the adapter and wraps it in a batcher if batching is configured, in a rate limiter if the
+// adapter has a rate limit or a global rate limiter is given, and in a circuit breaker if configured.
+func buildAdapter(ctx context.Context, name string, cfg AdapterConfig, globalLimiter *ratelimit.RateLimiter) (stream.Adapter, error) {
+	adapter, err := newAdapter(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Batch != nil {
+		batchAdapter, ok := adapter.(stream.BatchAdapter)
+		if !ok {
+			batchAdapter = stream.SingleMessageBatchAdapter{Adapter: adapter}
+		}
+		adapter = stream.NewBatcher(*cfg.Batch, batchAdapter)
+	}
+
+	var limiters []*ratelimit.RateLimiter
+	if globalLimiter != nil {
+		limiters = append(limiters, globalLimiter)
+	}
+	if cfg.RateLimit != nil && cfg.RateLimit.Enabled() {
+		limiters = append(limiters, ratelimit.New(name, *cfg.RateLimit))
+	}
+	if len(limiters) > 0 {
+		adapter = ratelimit.Wrap(adapter, limiters...)
+	}
+
+	// Messages wait for the circuit breaker before they take rate limit tokens.
+	if cfg.CircuitBreaker != nil {
+		adapter = circuitbreaker.Wrap(name, *cfg.CircuitBreaker, adapter)
+	}
+	return adapter, nil
+}
+
+func newAdapter(ctx context.Context, cfg AdapterConfig) (stream.Adapter, error) {
 	switch cfg.Type {
 	case AdapterTypeStdout:
 		return new(stdout.StdoutAdapter), nil
@@ -20,24 +57,30 @@ func buildAdapter(ctx context.Context, cfg AdapterConfig) (stream.Adapter, error
 			return nil, fmt.Errorf("kafka config is required")
 		}
 
-		opts, err := cfg.Kafka.Authentication.BuildOptions()
+		opts, err := kafkaClientOptions(cfg.Kafka)
 		if err != nil {
-			return nil, fmt.Errorf("error building authentication options: %w", err)
+			return nil, err
 		}
 
-		if cfg.Kafka.CreateTopic {
+		if cfg.Kafka.CreateTopic || cfg.Kafka.ReconcileTopic != kafka.TopicReconcileModeOff {
 			adminClient, err := kafka.NewAdminClient(cfg.Kafka.AdminHost, opts...)
 			if err != nil {
 				return nil, fmt.Errorf("error creating admin client: %w", err)
 			}
+			defer adminClient.Close()
 
-			topicOptions := []kafka.TopicOption{
-				kafka.SetTopicCompressionType(cfg.Kafka.CompressionType),
-				kafka.SetTopicRetention(cfg.Kafka.RetentionTime),
+			created := false
+			if cfg.Kafka.CreateTopic {
+				numPartitions, createOptions := createTopicOptions(cfg.Kafka)
+				if created, err = adminClient.CreateTopicIfNotExists(ctx, cfg.Kafka.TopicName, numPartitions, cfg.Kafka.ReplicationFactor, createOptions...); err != nil {
+					return nil, fmt.Errorf("error creating topic: %w", err)
+				}
 			}
 
-			if _, err := adminClient.CreateTopicIfNotExists(ctx, cfg.Kafka.TopicName, cfg.Kafka.NumPartitions, cfg.Kafka.ReplicationFactor, topicOptions...); err != nil {
-				return nil, fmt.Errorf("error creating topic: %w", err)
+			if !created && cfg.Kafka.ReconcileTopic != kafka.TopicReconcileModeOff {
+				if _, err := adminClient.ReconcileTopic(ctx, cfg.Kafka.ReconcileTopic, cfg.Kafka.TopicName, cfg.Kafka.NumPartitions, topicOptions(cfg.Kafka)...); err != nil {
+					return nil, fmt.Errorf("error reconciling topic: %w", err)
+				}
 			}
 		}
 
@@ -46,13 +89,81 @@ func buildAdapter(ctx context.Context, cfg AdapterConfig) (stream.Adapter, error
 			return nil, fmt.Errorf("error creating producer: %w", err)
 		}
 
-		go func() {
-			if err := producer.Run(ctx); err != nil {
-				logger.Log.Error("error running producer", zap.Error(err))
-			}
-		}()
-
 		return producer, nil
 	}
 	return nil, fmt.Errorf("unsupported adapter type: %s", cfg.Type)
 }
+
+// topicOptions returns the topic options that are configured, an existing topic is only reconciled with those.
+func topicOptions(cfg *KafkaConfig) []kafka.TopicOption {
+	return []kafka.TopicOption{
+		kafka.SetTopicCompressionType(cfg.CompressionType),
+		kafka.SetTopicRetention(cfg.RetentionTime),
+		kafka.SetTopicCleanupPolicy(cfg.CleanupPolicy),
+		kafka.SetTopicMinInsyncReplicas(cfg.MinInsyncReplicas),
+		kafka.SetTopicSegmentBytes(cfg.SegmentBytes),
+		kafka.SetTopicMaxMessageBytes(cfg.MaxMessageBytes),
+	}
+}
+
+// createTopicOptions returns the partition count and topic options for creating the topic, a new topic has a single
+// partition and is uncompressed unless configured otherwise.
+func createTopicOptions(cfg *KafkaConfig) (int, []kafka.TopicOption) {
+	options := append([]kafka.TopicOption{kafka.SetTopicCompressionType(kafka.TopicCompressionTypeNone)}, topicOptions(cfg)...)
+	return max(cfg.NumPartitions, 1), options
+}
+
+// kafkaClientOptions returns the options shared by the Kafka producer and admin clients.
+func kafkaClientOptions(cfg *KafkaConfig) ([]kafka.ClientOption, error) {
+	opts, err := cfg.Authentication.BuildOptions()
+	if err != nil {
+		return nil, fmt.Errorf("error building authentication options: %w", err)
+	}
+
+	if len(cfg.ExtraConfig) > 0 {
+		opts = append(opts, kafka.WithExtraConfig(cfg.ExtraConfig))
+	}
+	return opts, nil
+}
+
+// startAdapter runs the adapter until ctx is cancelled if it implements stream.Lifecycle.
+func startAdapter(ctx context.Context, adapter stream.Adapter) error {
+	lifecycle, ok := adapter.(stream.Lifecycle)
+	if !ok {
+		return nil
+	}
+
+	if err := lifecycle.Start(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		return fmt.Errorf("error running adapter: %w", err)
+	}
+	return nil
+}
+
+// stopAdapters flushes the adapters, then stops them using cancelStart and closes them once they have stopped.
+// Errors are logged, messages that were not flushed are not acknowledged and will be redelivered by Chain Watch.
+func stopAdapters(ctx context.Context, adapters []stream.Adapter, cancelStart context.CancelFunc, stopped <-chan struct{}) {
+	defer cancelStart()
+
+	for _, adapter := range adapters {
+		if lifecycle, ok := adapter.(stream.Lifecycle); ok {
+			if err := lifecycle.Flush(ctx); err != nil {
+				logger.Log.Error("error flushing adapter", zap.Error(err))
+			}
+		}
+	}
+
+	cancelStart()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		logger.Log.Warn("adapters did not stop before the shutdown timeout")
+	}
+
+	for _, adapter := range adapters {
+		if lifecycle, ok := adapter.(stream.Lifecycle); ok {
+			if err := lifecycle.Close(ctx); err != nil {
+				logger.Log.Error("error closing adapter", zap.Error(err))
+			}
+		}
+	}
+}
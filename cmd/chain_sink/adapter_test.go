@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/blockdaemon/chain_sink/pkg/adapters/kafka"
+	"github.com/stretchr/testify/assert"
+)
+
+func applyTopicOptions(opts []kafka.TopicOption) map[string]string {
+	configMap := make(map[string]string)
+	for _, opt := range opts {
+		opt(configMap)
+	}
+	return configMap
+}
+
+func TestTopicOptions(t *testing.T) {
+	cfg := &KafkaConfig{TopicName: "events", CleanupPolicy: "compact"}
+
+	assert.Equal(t, map[string]string{"cleanup.policy": "compact"}, applyTopicOptions(topicOptions(cfg)),
+		"an unset compression_type is not reconciled")
+
+	numPartitions, createOptions := createTopicOptions(cfg)
+	assert.Equal(t, 1, numPartitions)
+	assert.Equal(t, map[string]string{"cleanup.policy": "compact", "compression.type": "uncompressed"},
+		applyTopicOptions(createOptions))
+
+	cfg.NumPartitions, cfg.CompressionType = 6, kafka.TopicCompressionTypeZstd
+	assert.Equal(t, "zstd", applyTopicOptions(topicOptions(cfg))["compression.type"])
+	numPartitions, createOptions = createTopicOptions(cfg)
+	assert.Equal(t, 6, numPartitions)
+	assert.Equal(t, "zstd", applyTopicOptions(createOptions)["compression.type"])
+}
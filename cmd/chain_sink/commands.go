@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blockdaemon/chain_sink/pkg/adapters/kafka"
+	"github.com/blockdaemon/chain_sink/pkg/config"
+	"github.com/blockdaemon/chain_sink/pkg/stream"
+	"go.yaml.in/yaml/v3"
+)
+
+// version is set when building, with -ldflags "-X main.version=<version>".
+var version = "dev"
+
+// configFiles is the repeatable --config flag, later files are merged into earlier ones.
+type configFiles []string
+
+func (f *configFiles) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *configFiles) Set(file string) error {
+	*f = append(*f, file)
+	return nil
+}
+
+func newConfigFlagSet(name string) (*flag.FlagSet, *configFiles) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(os.Stderr)
+	files := new(configFiles)
+	flags.Var(files, "config", "Config file, can be repeated, BD_CONFIG_FILES is used if not given")
+	return flags, files
+}
+
+// dialTimeout limits the connection tests of the validate command.
+const dialTimeout = 30 * time.Second
+
+// runValidate loads and validates the config, builds the processors and, unless --offline is given, checks the targets
+// of the streams and connects to the adapters. Every check is reported to stdout, an error is returned if a check failed.
+func runValidate(ctx context.Context, args []string, stdout io.Writer) error {
+	flags, files := newConfigFlagSet("validate")
+	var offline bool
+	flags.BoolVar(&offline, "offline", false, "Only validate the configuration, without checking the stream targets and connecting to the adapters")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := LoadConfig(*files...)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, "ok    config")
+
+	failed := 0
+	report := func(check string, err error) {
+		if err != nil {
+			failed++
+			fmt.Fprintf(stdout, "FAIL  %s: %s\n", check, err)
+			return
+		}
+		fmt.Fprintf(stdout, "ok    %s\n", check)
+	}
+
+	streams := make(map[string]StreamConfig)
+	for _, s := range cfg.StreamConfigs() {
+		streams[s.Name] = s
+	}
+	// The quarantine adapters are not built, they are connected to below.
+	noAdapter := func(string) (stream.Adapter, error) { return nil, nil }
+	for _, p := range cfg.PipelineConfigs() {
+		for i, processorCfg := range p.Processors {
+			_, err := buildProcessor(ctx, processorCfg, p.Name, streams[p.Source], noAdapter)
+			report(fmt.Sprintf("pipeline %s processor %d (%s)", p.Name, i+1, processorCfg.Type), err)
+		}
+	}
+
+	if !offline {
+		for _, s := range cfg.StreamConfigs() {
+			report("stream "+s.Name, checkStream(ctx, s.Config))
+		}
+
+		adapterConfigs := cfg.AdapterConfigs()
+		for _, s := range cfg.StreamConfigs() {
+			if s.Adapter != nil {
+				adapterConfigs[streamAdapterName(s.Name)] = *s.Adapter
+			}
+		}
+		names := make([]string, 0, len(adapterConfigs))
+		for name := range adapterConfigs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			report("adapter "+name, checkAdapter(ctx, adapterConfigs[name]))
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("validation failed: %d of the checks failed", failed)
+	}
+	return nil
+}
+
+// checkStream queries the target of the stream from the Chain Watch API and compares its mode with the stream mode.
+// The websocket is not opened, Chain Watch would send it messages, which are lost in noack mode, and it could take over
+// the connection of a running chain sink.
+func checkStream(ctx context.Context, cfg stream.Config) error {
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	return stream.CheckTarget(ctx, cfg)
+}
+
+// checkAdapter connects to the system the adapter delivers to, without creating or changing anything.
+func checkAdapter(ctx context.Context, cfg AdapterConfig) error {
+	switch cfg.Type {
+	case AdapterTypeStdout:
+		return nil
+	case AdapterTypeKafka:
+		if cfg.Kafka == nil {
+			return fmt.Errorf("kafka config is required")
+		}
+		opts, err := kafkaClientOptions(cfg.Kafka)
+		if err != nil {
+			return err
+		}
+
+		host := cfg.Kafka.AdminHost
+		if host == "" {
+			host = strings.Join(cfg.Kafka.Producer.Brokers, ",")
+		}
+		adminClient, err := kafka.NewAdminClient(host, opts...)
+		if err != nil {
+			return fmt.Errorf("error creating admin client: %w", err)
+		}
+		defer adminClient.Close()
+
+		ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+		defer cancel()
+		exists, err := adminClient.TopicExists(ctx, cfg.Kafka.TopicName)
+		if err != nil {
+			return err
+		}
+		if !exists && !cfg.Kafka.CreateTopic {
+			return fmt.Errorf("topic %s does not exist and create_topic is disabled", cfg.Kafka.TopicName)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported adapter type: %s", cfg.Type)
+}
+
+const configUsage = `Usage: chain_sink config print [flags]
+
+Prints the configuration, merged from all config files and with the default values applied. Secrets are redacted.
+`
+
+// runConfig runs the config command with the arguments following "config".
+func runConfig(args []string, stdout io.Writer) error {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprint(stdout, configUsage)
+		if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+			return nil
+		}
+		return fmt.Errorf("unknown config command %q", args[0])
+	}
+
+	flags, files := newConfigFlagSet("config print")
+	var format string
+	flags.StringVar(&format, "format", "yaml", "Output format, yaml or json")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	cfg, err := LoadConfig(*files...)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "yaml":
+		encoder := yaml.NewEncoder(stdout)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(config.Map(cfg)); err != nil {
+			return err
+		}
+		return encoder.Close()
+	case "json":
+		return writeJSON(stdout, config.Map(cfg))
+	}
+	return errors.New("invalid format: expected yaml or json")
+}
+
+func runVersion(stdout io.Writer) error {
+	fmt.Fprintf(stdout, "chain_sink %s\n", version)
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				fmt.Fprintf(stdout, "commit: %s\n", setting.Value)
+			}
+		}
+		fmt.Fprintf(stdout, "go: %s\n", info.GoVersion)
+	}
+	return nil
+}
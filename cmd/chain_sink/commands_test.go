@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blockdaemon/chain_sink/pkg/chainwatch"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestRunConfig_print(t *testing.T) {
+	path := writeTestConfig(t, `
+stream:
+  url: "ws://localhost:8765/targets/`+testTargetOne+`/websocket"
+  api_key: "stream-api-key"
+  headers:
+    - key: Authorization
+      value: "Bearer header-token"
+adapter:
+  type: kafka
+  kafka:
+    topic_name: events
+    authentication:
+      type: sasl_ssl
+      password: "kafka-password"
+    producer:
+      serializer:
+        format: avro
+        url: "http://localhost:8081"
+        password: "registry-password"
+`)
+
+	var stdout bytes.Buffer
+	require.NoError(t, runConfig([]string{"print", "--config", path}, &stdout))
+	output := stdout.String()
+	assert.Contains(t, output, "topic_name: events")
+	assert.Contains(t, output, "worker_pool_size: 1", "default values are printed")
+	assert.Contains(t, output, "api_key: '[redacted]'")
+	for _, secret := range []string{"stream-api-key", "header-token", "kafka-password", "registry-password"} {
+		assert.NotContains(t, output, secret)
+	}
+
+	stdout.Reset()
+	require.NoError(t, runConfig([]string{"print", "--format", "json", "--config", path}, &stdout))
+	for _, secret := range []string{"stream-api-key", "header-token", "kafka-password", "registry-password"} {
+		assert.NotContains(t, stdout.String(), secret)
+	}
+}
+
+func TestRunValidate(t *testing.T) {
+	// Only the targets API is served, the websocket is not opened.
+	api := &fakeTargetsAPI{targets: map[string]chainwatch.Target{
+		testTargetOne: {Id: testTargetOne, Settings: chainwatch.TargetSettings{Mode: chainwatch.TargetModeAck}},
+	}}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	path := writeTestConfig(t, `
+stream:
+  url: "ws`+strings.TrimPrefix(server.URL, "http")+`/targets/`+testTargetOne+`/websocket"
+  api_key: test-key
+pipelines:
+  - name: checked
+    source: `+testTargetOne+`
+    sinks: [default]
+    processors:
+      - type: filter
+        filter:
+          expression: 'type == "block"'
+`)
+
+	var stdout bytes.Buffer
+	require.NoError(t, runValidate(context.Background(), []string{"--config", path}, &stdout))
+	assert.Equal(t, "ok    config\nok    pipeline checked processor 1 (filter)\nok    stream "+testTargetOne+"\nok    adapter default\n", stdout.String())
+
+	api.targets[testTargetOne] = chainwatch.Target{Id: testTargetOne, Settings: chainwatch.TargetSettings{Mode: chainwatch.TargetModeNoAck}}
+	stdout.Reset()
+	assert.EqualError(t, runValidate(context.Background(), []string{"--config", path}, &stdout), "validation failed: 1 of the checks failed")
+	assert.Contains(t, stdout.String(), "FAIL  stream "+testTargetOne+": stream mode does not match the mode of the Chain Watch target: "+
+		"the stream is configured with ack, target "+testTargetOne+" has mode noack")
+}
+
+func TestRunValidate_failedChecks(t *testing.T) {
+	path := writeTestConfig(t, `
+stream:
+  url: "ws://127.0.0.1:1/targets/`+testTargetOne+`/websocket"
+pipelines:
+  - name: checked
+    source: `+testTargetOne+`
+    sinks: [default]
+    processors:
+      - type: schema
+        schema:
+          schemas:
+            - file: does-not-exist.json
+`)
+
+	var stdout bytes.Buffer
+	err := runValidate(context.Background(), []string{"--config", path}, &stdout)
+	assert.EqualError(t, err, "validation failed: 2 of the checks failed")
+	assert.Contains(t, stdout.String(), "FAIL  pipeline checked processor 1 (schema): error loading schema file does-not-exist.json")
+	assert.Contains(t, stdout.String(), "FAIL  stream "+testTargetOne+": ")
+
+	stdout.Reset()
+	err = runValidate(context.Background(), []string{"--offline", "--config", path}, &stdout)
+	assert.EqualError(t, err, "validation failed: 1 of the checks failed")
+	assert.NotContains(t, stdout.String(), "stream")
+
+	err = runValidate(context.Background(), []string{"--config", writeTestConfig(t, "stream_count: 1\n")}, &stdout)
+	assert.ErrorContains(t, err, "no stream configured")
+}
+
+func TestRunVersion(t *testing.T) {
+	var stdout bytes.Buffer
+	require.NoError(t, runVersion(&stdout))
+	assert.True(t, strings.HasPrefix(stdout.String(), "chain_sink dev\n"))
+}
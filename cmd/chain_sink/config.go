@@ -1,18 +1,83 @@
 package main
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/blockdaemon/chain_sink/pkg/adapters/kafka"
+	"github.com/blockdaemon/chain_sink/pkg/circuitbreaker"
 	"github.com/blockdaemon/chain_sink/pkg/config"
 	"github.com/blockdaemon/chain_sink/pkg/logger"
+	"github.com/blockdaemon/chain_sink/pkg/processors/dedup"
+	"github.com/blockdaemon/chain_sink/pkg/processors/filter"
+	"github.com/blockdaemon/chain_sink/pkg/processors/schema"
+	"github.com/blockdaemon/chain_sink/pkg/processors/transform"
+	"github.com/blockdaemon/chain_sink/pkg/ratelimit"
+	"github.com/blockdaemon/chain_sink/pkg/reorder"
 	"github.com/blockdaemon/chain_sink/pkg/stream"
 )
 
 type Config struct {
-	Logger      logger.Config `mapstructure:"logger"`
-	Stream      stream.Config `mapstructure:"stream"`
-	StreamCount int           `mapstructure:"stream_count" default:"1"`
-	Adapter     AdapterConfig `mapstructure:"adapter"`
-	Metrics     MetricsConfig `mapstructure:"metrics"`
+	Logger logger.Config `mapstructure:"logger"`
+	// Stream and StreamCount configure a single Chain Watch target, use Streams to configure multiple targets.
+	Stream      *stream.Config `mapstructure:"stream"`
+	StreamCount int            `mapstructure:"stream_count" default:"1"`
+	Streams     []StreamConfig `mapstructure:"streams" validate:"dive"`
+	// Adapter is the default adapter for streams that are not the source of a pipeline and have no own adapter.
+	Adapter AdapterConfig `mapstructure:"adapter"`
+	// Adapters are named adapters that can be used as pipeline sinks.
+	Adapters  []NamedAdapterConfig `mapstructure:"adapters" validate:"dive"`
+	Pipelines []PipelineConfig     `mapstructure:"pipelines" validate:"dive"`
+	// RateLimit limits the deliveries to all adapters together, it is applied in addition to the adapters' own limits.
+	RateLimit *ratelimit.Config `mapstructure:"rate_limit"`
+	Metrics   MetricsConfig     `mapstructure:"metrics"`
+	// ShutdownTimeout is the deadline for flushing and closing the adapter after the streams stopped.
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout" default:"30s"`
+}
+
+// StreamConfig configures a Chain Watch target. Streams without an adapter use the top level adapter.
+type StreamConfig struct {
+	stream.Config `mapstructure:",squash"`
+	// Name identifies the stream in logs, it defaults to the target id.
+	Name    string         `mapstructure:"name"`
+	Count   int            `mapstructure:"count" default:"1" validate:"gte=1"`
+	Adapter *AdapterConfig `mapstructure:"adapter"`
+}
+
+// DefaultAdapterName is the name of the top level adapter, it can be used as pipeline sink.
+const DefaultAdapterName = "default"
+
+type NamedAdapterConfig struct {
+	AdapterConfig `mapstructure:",squash"`
+	Name          string `mapstructure:"name" validate:"required"`
+}
+
+// PipelineConfig routes the messages of a source stream through the processors, in order, to every sink.
+type PipelineConfig struct {
+	Name       string            `mapstructure:"name" validate:"required"`
+	Source     string            `mapstructure:"source" validate:"required"`
+	Processors []ProcessorConfig `mapstructure:"processors" validate:"dive"`
+	Sinks      []string          `mapstructure:"sinks" validate:"required,min=1"`
+	// Reorder sorts the events of the source stream by their position in the chain before they are processed.
+	Reorder *reorder.Config `mapstructure:"reorder"`
+}
+
+type ProcessorType string
+
+const (
+	ProcessorTypeFilter    ProcessorType = "filter"
+	ProcessorTypeTransform ProcessorType = "transform"
+	ProcessorTypeDedup     ProcessorType = "dedup"
+	ProcessorTypeSchema    ProcessorType = "schema"
+)
+
+type ProcessorConfig struct {
+	Type      ProcessorType     `mapstructure:"type" validate:"oneof=filter transform dedup schema"`
+	Filter    *filter.Config    `mapstructure:"filter" validate:"required_if=Type filter"`
+	Transform *transform.Config `mapstructure:"transform" validate:"required_if=Type transform"`
+	Schema    *schema.Config    `mapstructure:"schema" validate:"required_if=Type schema"`
+	// Dedup is optional, the defaults deduplicate by message id.
+	Dedup *dedup.Config `mapstructure:"dedup"`
 }
 
 type AdapterType string
@@ -25,6 +90,13 @@ const (
 type AdapterConfig struct {
 	Type  AdapterType  `mapstructure:"type" validate:"oneof=stdout kafka" default:"stdout"`
 	Kafka *KafkaConfig `mapstructure:"kafka"`
+	// Batch hands the messages to the adapter in batches, batching is disabled if nil.
+	Batch *stream.BatchConfig `mapstructure:"batch"`
+	// RateLimit limits the deliveries to the adapter, rate limiting is disabled if nil.
+	RateLimit *ratelimit.Config `mapstructure:"rate_limit"`
+	// CircuitBreaker retries failed deliveries and pauses the adapter while it keeps failing, instead of stopping the
+	// application on the first error. It is disabled if nil.
+	CircuitBreaker *circuitbreaker.Config `mapstructure:"circuit_breaker"`
 }
 
 type KafkaConfig struct {
@@ -32,11 +104,17 @@ type KafkaConfig struct {
 	Producer          kafka.ProducerConfig       `mapstructure:"producer" validate:"required"`
 	CreateTopic       bool                       `mapstructure:"create_topic"`
 	TopicName         string                     `mapstructure:"topic_name" validate:"required"`
-	NumPartitions     int                        `mapstructure:"num_partitions" default:"1"`
+	NumPartitions     int                        `mapstructure:"num_partitions" validate:"gte=0"`
 	ReplicationFactor int                        `mapstructure:"replication_factor" default:"1"`
-	CompressionType   kafka.TopicCompressionType `mapstructure:"compression_type" default:"uncompressed" validate:"oneof='' uncompressed producer gzip snappy lz4 zstd"`
+	CompressionType   kafka.TopicCompressionType `mapstructure:"compression_type" validate:"oneof='' uncompressed producer gzip snappy lz4 zstd"`
 	RetentionTime     string                     `mapstructure:"retention_time"`
+	CleanupPolicy     string                     `mapstructure:"cleanup_policy"`
+	MinInsyncReplicas int                        `mapstructure:"min_insync_replicas" validate:"gte=0"`
+	SegmentBytes      int64                      `mapstructure:"segment_bytes" validate:"gte=0"`
+	MaxMessageBytes   int                        `mapstructure:"max_message_bytes" validate:"gte=0"`
+	ReconcileTopic    kafka.TopicReconcileMode   `mapstructure:"reconcile_topic" default:"off" validate:"oneof=off report dry_run apply"`
 	AdminHost         string                     `mapstructure:"admin_host"`
+	ExtraConfig       map[string]any             `mapstructure:"extra_config"`
 }
 
 type MetricsConfig struct {
@@ -44,6 +122,181 @@ type MetricsConfig struct {
 	Port    int  `mapstructure:"port" default:"8421"`
 }
 
-func LoadConfig() (Config, error) {
-	return config.LoadConfig[Config]()
+// Validate checks that either a single stream or a list of streams is configured, and that the pipelines refer to
+// existing streams and adapters.
+func (c *Config) Validate() error {
+	if c.Stream != nil && len(c.Streams) > 0 {
+		return fmt.Errorf("stream and streams can not be configured together")
+	}
+
+	streams := c.StreamConfigs()
+	if len(streams) == 0 {
+		return fmt.Errorf("no stream configured: configure either stream or streams")
+	}
+
+	streamsByName := make(map[string]StreamConfig, len(streams))
+	for _, s := range streams {
+		if err := s.Config.Validate(); err != nil {
+			return fmt.Errorf("stream %s: %w", s.Name, err)
+		}
+		if _, ok := streamsByName[s.Name]; ok {
+			return fmt.Errorf("duplicate stream name: %s", s.Name)
+		}
+		if s.Adapter != nil {
+			if err := s.Adapter.Validate(); err != nil {
+				return fmt.Errorf("stream %s adapter: %w", s.Name, err)
+			}
+		}
+		streamsByName[s.Name] = s
+	}
+
+	if c.RateLimit != nil {
+		if err := c.RateLimit.Validate(); err != nil {
+			return fmt.Errorf("rate_limit: %w", err)
+		}
+	}
+
+	adapters := make(map[string]struct{}, len(c.Adapters)+1)
+	adapters[DefaultAdapterName] = struct{}{}
+	if err := c.Adapter.Validate(); err != nil {
+		return fmt.Errorf("adapter: %w", err)
+	}
+	for _, a := range c.Adapters {
+		if a.Name == DefaultAdapterName {
+			return fmt.Errorf("adapter name %s is reserved for the top level adapter", DefaultAdapterName)
+		}
+		if _, ok := adapters[a.Name]; ok {
+			return fmt.Errorf("duplicate adapter name: %s", a.Name)
+		}
+		adapters[a.Name] = struct{}{}
+		if err := a.Validate(); err != nil {
+			return fmt.Errorf("adapter %s: %w", a.Name, err)
+		}
+	}
+
+	pipelines := make(map[string]struct{}, len(c.Pipelines))
+	sources := make(map[string]string, len(c.Pipelines))
+	for _, p := range c.Pipelines {
+		if _, ok := pipelines[p.Name]; ok {
+			return fmt.Errorf("duplicate pipeline name: %s", p.Name)
+		}
+		pipelines[p.Name] = struct{}{}
+
+		source, ok := streamsByName[p.Source]
+		if !ok {
+			return fmt.Errorf("pipeline %s: unknown source stream %s", p.Name, p.Source)
+		}
+		// Chain Watch delivers every message to one connection, so a stream can only feed a single pipeline.
+		if other, ok := sources[p.Source]; ok {
+			return fmt.Errorf("pipeline %s: stream %s is already the source of pipeline %s", p.Name, p.Source, other)
+		}
+		sources[p.Source] = p.Name
+		if source.Adapter != nil {
+			return fmt.Errorf("pipeline %s: source stream %s can not have its own adapter", p.Name, p.Source)
+		}
+		// In ack mode the next event is only sent once the previous one was acknowledged, so every event would wait
+		// the full window.
+		if p.Reorder != nil && source.Mode == stream.StreamModeAck {
+			return fmt.Errorf("pipeline %s: reorder requires a noack source stream, %s is in ack mode", p.Name, p.Source)
+		}
+		if p.Reorder != nil && source.TargetCheck != nil && source.TargetCheck.OnModeMismatch == stream.ModeMismatchActionAuto {
+			return fmt.Errorf("pipeline %s: reorder can not be used with on_mode_mismatch auto, which can switch stream %s to ack mode", p.Name, p.Source)
+		}
+
+		for _, sink := range p.Sinks {
+			if _, ok := adapters[sink]; !ok {
+				return fmt.Errorf("pipeline %s: unknown sink %s", p.Name, sink)
+			}
+		}
+
+		for _, processor := range p.Processors {
+			if processor.Schema == nil || processor.Schema.Quarantine == "" {
+				continue
+			}
+			if _, ok := adapters[processor.Schema.Quarantine]; !ok {
+				return fmt.Errorf("pipeline %s: unknown quarantine adapter %s", p.Name, processor.Schema.Quarantine)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the settings that the struct tags can not express.
+func (c *AdapterConfig) Validate() error {
+	if c.RateLimit != nil {
+		if err := c.RateLimit.Validate(); err != nil {
+			return fmt.Errorf("rate_limit: %w", err)
+		}
+	}
+	if c.Kafka != nil && c.Kafka.RetentionTime != "" {
+		if _, err := kafka.ParseTopicRetention(c.Kafka.RetentionTime); err != nil {
+			return fmt.Errorf("kafka: %w", err)
+		}
+	}
+	return nil
+}
+
+// StreamConfigs returns the configured streams, a single configured stream is returned as a list of one.
+func (c *Config) StreamConfigs() []StreamConfig {
+	streams := c.Streams
+	if c.Stream != nil {
+		streams = []StreamConfig{{Config: *c.Stream, Count: c.StreamCount}}
+	}
+
+	result := make([]StreamConfig, 0, len(streams))
+	for _, s := range streams {
+		if s.Name == "" {
+			s.Name = s.TargetId()
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+// AdapterConfigs returns the named adapters, including the top level adapter as DefaultAdapterName.
+func (c *Config) AdapterConfigs() map[string]AdapterConfig {
+	adapters := make(map[string]AdapterConfig, len(c.Adapters)+1)
+	adapters[DefaultAdapterName] = c.Adapter
+	for _, a := range c.Adapters {
+		adapters[a.Name] = a.AdapterConfig
+	}
+	return adapters
+}
+
+// PipelineConfigs returns the configured pipelines, followed by a pipeline for every stream that is not the source
+// of a configured pipeline. Those pipelines forward to the stream's own adapter, or the top level adapter.
+func (c *Config) PipelineConfigs() []PipelineConfig {
+	pipelines := append([]PipelineConfig(nil), c.Pipelines...)
+
+	sources := make(map[string]struct{}, len(c.Pipelines))
+	for _, p := range c.Pipelines {
+		sources[p.Source] = struct{}{}
+	}
+
+	for _, s := range c.StreamConfigs() {
+		if _, ok := sources[s.Name]; ok {
+			continue
+		}
+		sink := DefaultAdapterName
+		if s.Adapter != nil {
+			sink = streamAdapterName(s.Name)
+		}
+		pipelines = append(pipelines, PipelineConfig{Name: s.Name, Source: s.Name, Sinks: []string{sink}})
+	}
+
+	return pipelines
+}
+
+// streamAdapterName is the adapter name used for the adapter configured on a stream.
+func streamAdapterName(streamName string) string {
+	return "stream:" + streamName
+}
+
+// LoadConfig loads the config files, or the files listed in BD_CONFIG_FILES if none are given.
+func LoadConfig(files ...string) (Config, error) {
+	if len(files) == 0 {
+		return config.LoadConfig[Config]()
+	}
+	return config.LoadConfigFiles[Config](files...)
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/blockdaemon/chain_sink/pkg/processors/schema"
+	"github.com/blockdaemon/chain_sink/pkg/ratelimit"
+	"github.com/blockdaemon/chain_sink/pkg/reorder"
+	"github.com/blockdaemon/chain_sink/pkg/stream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testTargetOne = "ceac6435-b9af-441c-abf3-f78de9bfc32c"
+	testTargetTwo = "e61f5784-8d00-4251-b809-c631c58840ae"
+)
+
+func testStreamConfig(targetId string) stream.Config {
+	return stream.Config{URL: "ws://localhost:8765/targets/" + targetId + "/websocket"}
+}
+
+func TestConfig_StreamConfigs(t *testing.T) {
+	single := testStreamConfig(testTargetOne)
+	cfg := Config{Stream: &single, StreamCount: 2}
+	require.NoError(t, cfg.Validate())
+	assert.Equal(t, []StreamConfig{{Config: single, Name: testTargetOne, Count: 2}}, cfg.StreamConfigs())
+
+	cfg = Config{Streams: []StreamConfig{
+		{Config: testStreamConfig(testTargetOne), Name: "ethereum", Count: 1},
+		{Config: testStreamConfig(testTargetTwo), Count: 1, Adapter: &AdapterConfig{Type: AdapterTypeStdout}},
+	}}
+	require.NoError(t, cfg.Validate())
+	streams := cfg.StreamConfigs()
+	assert.Equal(t, "ethereum", streams[0].Name)
+	assert.Equal(t, testTargetTwo, streams[1].Name)
+}
+
+func TestConfig_Validate(t *testing.T) {
+	single := testStreamConfig(testTargetOne)
+
+	tests := []struct {
+		name string
+		cfg  Config
+		err  string
+	}{
+		{name: "no streams", cfg: Config{}, err: "no stream configured"},
+		{name: "stream and streams", cfg: Config{Stream: &single, Streams: []StreamConfig{{Config: single}}}, err: "can not be configured together"},
+		{name: "duplicate names", cfg: Config{Streams: []StreamConfig{{Config: single}, {Config: single}}}, err: "duplicate stream name"},
+		{name: "invalid url", cfg: Config{Streams: []StreamConfig{{Config: stream.Config{URL: "ws://localhost"}, Name: "invalid"}}}, err: "stream invalid: invalid url"},
+		{name: "reserved adapter name", cfg: Config{Stream: &single, Adapters: []NamedAdapterConfig{{Name: DefaultAdapterName}}}, err: "reserved"},
+		{name: "duplicate adapter", cfg: Config{Stream: &single, Adapters: []NamedAdapterConfig{{Name: "a"}, {Name: "a"}}}, err: "duplicate adapter name: a"},
+		{name: "unknown source", cfg: Config{Stream: &single, Pipelines: []PipelineConfig{{Name: "p", Source: "other", Sinks: []string{DefaultAdapterName}}}}, err: "unknown source stream other"},
+		{name: "unknown sink", cfg: Config{Stream: &single, Pipelines: []PipelineConfig{{Name: "p", Source: testTargetOne, Sinks: []string{"kafka"}}}}, err: "unknown sink kafka"},
+		{name: "duplicate pipeline", cfg: Config{Streams: []StreamConfig{{Config: single}, {Config: testStreamConfig(testTargetTwo)}}, Pipelines: []PipelineConfig{
+			{Name: "p", Source: testTargetOne, Sinks: []string{DefaultAdapterName}},
+			{Name: "p", Source: testTargetTwo, Sinks: []string{DefaultAdapterName}},
+		}}, err: "duplicate pipeline name: p"},
+		{name: "shared source", cfg: Config{Stream: &single, Pipelines: []PipelineConfig{
+			{Name: "p1", Source: testTargetOne, Sinks: []string{DefaultAdapterName}},
+			{Name: "p2", Source: testTargetOne, Sinks: []string{DefaultAdapterName}},
+		}}, err: "already the source of pipeline p1"},
+		{name: "source with adapter", cfg: Config{Streams: []StreamConfig{{Config: single, Adapter: &AdapterConfig{}}}, Pipelines: []PipelineConfig{
+			{Name: "p", Source: testTargetOne, Sinks: []string{DefaultAdapterName}},
+		}}, err: "can not have its own adapter"},
+		{name: "reorder with ack source", cfg: Config{Stream: &stream.Config{URL: single.URL, Mode: stream.StreamModeAck}, Pipelines: []PipelineConfig{
+			{Name: "p", Source: testTargetOne, Sinks: []string{DefaultAdapterName}, Reorder: &reorder.Config{}},
+		}}, err: "reorder requires a noack source stream"},
+		{name: "reorder with auto mode", cfg: Config{Stream: &stream.Config{URL: single.URL, Mode: stream.StreamModeNoAck, TargetCheck: &stream.TargetCheckConfig{OnModeMismatch: stream.ModeMismatchActionAuto}}, Pipelines: []PipelineConfig{
+			{Name: "p", Source: testTargetOne, Sinks: []string{DefaultAdapterName}, Reorder: &reorder.Config{}},
+		}}, err: "reorder can not be used with on_mode_mismatch auto"},
+		{name: "unknown quarantine", cfg: Config{Stream: &single, Pipelines: []PipelineConfig{{Name: "p", Source: testTargetOne, Sinks: []string{DefaultAdapterName},
+			Processors: []ProcessorConfig{{Type: ProcessorTypeSchema, Schema: &schema.Config{Quarantine: "invalid"}}},
+		}}}, err: "unknown quarantine adapter invalid"},
+		{name: "adaptive without rate", cfg: Config{Stream: &single, RateLimit: &ratelimit.Config{Adaptive: ratelimit.AdaptiveConfig{Enabled: true}}},
+			err: "rate_limit: adaptive rate limiting requires messages_per_second or bytes_per_second"},
+		{name: "adapter adaptive without rate", cfg: Config{Stream: &single, Adapter: AdapterConfig{RateLimit: &ratelimit.Config{Adaptive: ratelimit.AdaptiveConfig{Enabled: true}}}},
+			err: "adapter: rate_limit: adaptive rate limiting requires"},
+		{name: "invalid retention time", cfg: Config{Stream: &single, Adapters: []NamedAdapterConfig{{Name: "kafka", AdapterConfig: AdapterConfig{
+			Type: AdapterTypeKafka, Kafka: &KafkaConfig{RetentionTime: "7 days"},
+		}}}}, err: `adapter kafka: kafka: invalid retention time "7 days"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.ErrorContains(t, test.cfg.Validate(), test.err)
+		})
+	}
+}
+
+func TestConfig_PipelineConfigs(t *testing.T) {
+	cfg := Config{
+		Streams: []StreamConfig{
+			{Config: testStreamConfig(testTargetOne), Name: "ethereum"},
+			{Config: testStreamConfig(testTargetTwo), Name: "polygon", Adapter: &AdapterConfig{Type: AdapterTypeStdout}},
+			{Config: testStreamConfig("0d4a4b2e-3a0f-4a54-9f1c-5b7b2b6f2c11"), Name: "bitcoin"},
+		},
+		Adapters: []NamedAdapterConfig{{Name: "archive", AdapterConfig: AdapterConfig{Type: AdapterTypeStdout}}},
+		Pipelines: []PipelineConfig{
+			{Name: "ethereum-fanout", Source: "ethereum", Sinks: []string{DefaultAdapterName, "archive"}},
+		},
+	}
+	require.NoError(t, cfg.Validate())
+
+	assert.Equal(t, []PipelineConfig{
+		{Name: "ethereum-fanout", Source: "ethereum", Sinks: []string{DefaultAdapterName, "archive"}},
+		{Name: "polygon", Source: "polygon", Sinks: []string{"stream:polygon"}},
+		{Name: "bitcoin", Source: "bitcoin", Sinks: []string{DefaultAdapterName}},
+	}, cfg.PipelineConfigs())
+}
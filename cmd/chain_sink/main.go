@@ -2,7 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
 
 	"github.com/blockdaemon/chain_sink/pkg/appctx"
 	"github.com/blockdaemon/chain_sink/pkg/logger"
@@ -13,9 +19,63 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
+const usage = `Usage: chain_sink [command] [flags]
+
+Commands:
+  run            Run the streams, the default command
+  validate       Validate the configuration, check the stream targets and test the adapter connections
+  config print   Print the configuration with secrets redacted
+  targets        Manage Chain Watch targets
+  version        Print the version
+
+The configuration files are given with --config, which can be repeated, or in the BD_CONFIG_FILES environment variable.
+`
+
 func main() {
+	command, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	var err error
+	switch command {
+	case "run":
+		err = runRun(args)
+	case "validate":
+		logger.Init(logger.Config{Level: "error"})
+		err = runValidate(context.Background(), args, os.Stdout)
+	case "config":
+		logger.Init(logger.Config{Level: "error"})
+		err = runConfig(args, os.Stdout)
+	case "targets":
+		logger.Init(logger.Config{Level: "error"})
+		err = runTargets(context.Background(), args, os.Stdout)
+	case "version":
+		err = runVersion(os.Stdout)
+	case "help":
+		fmt.Print(usage)
+	default:
+		err = fmt.Errorf("unknown command %q\n\n%s", command, usage)
+	}
 
-	cfg, err := LoadConfig()
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func runRun(args []string) error {
+	flags, files := newConfigFlagSet("run")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	run(*files)
+	return nil
+}
+
+// run runs the streams until the application context is cancelled, errors are fatal.
+func run(files configFiles) {
+	cfg, err := LoadConfig(files...)
 	if err != nil {
 		logger.Init(logger.Config{Level: "error"})
 		logger.Log.Fatal("error loading config", zap.Error(err))
@@ -26,23 +86,14 @@ func main() {
 	ctx, cancel := appctx.Context()
 	defer cancel()
 
-	adapter, err := buildAdapter(ctx, cfg.Adapter)
+	streams := cfg.StreamConfigs()
+	streamAdapters, adapters, err := buildPipelines(ctx, cfg)
 	if err != nil {
-		logger.Log.Fatal("error building adapter", zap.Error(err))
+		logger.Log.Fatal("error building pipelines", zap.Error(err))
 	}
 
 	group, gCtx := errgroup.WithContext(ctx)
 
-	for range cfg.StreamCount {
-		group.Go(func() error {
-			chainWatchStream, err := stream.NewChainWatchStream(gCtx, cfg.Stream)
-			if err != nil {
-				return err
-			}
-			return chainWatchStream.ForwardMessagesToAdapter(gCtx, adapter)
-		})
-	}
-
 	if cfg.Metrics.Enabled {
 		_, err := metrics.Init(gCtx)
 		if err != nil {
@@ -53,7 +104,10 @@ func main() {
 		server.GET("/metrics", echo.WrapHandler(metrics.Handler()))
 		group.Go(func() error {
 			logger.Log.Info("starting metrics server", zap.Int("port", cfg.Metrics.Port))
-			return server.Start(fmt.Sprintf(":%d", cfg.Metrics.Port))
+			if err := server.Start(fmt.Sprintf(":%d", cfg.Metrics.Port)); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
 		})
 
 		group.Go(func() error {
@@ -63,7 +117,49 @@ func main() {
 		})
 	}
 
-	if err := group.Wait(); err != nil {
+	// The adapters run with their own context, so they keep delivering while the streams shut down.
+	adapterCtx, cancelAdapters := context.WithCancel(context.WithoutCancel(gCtx))
+	var adaptersRunning sync.WaitGroup
+	for _, adapter := range adapters {
+		adaptersRunning.Add(1)
+		group.Go(func() error {
+			defer adaptersRunning.Done()
+			return startAdapter(adapterCtx, adapter)
+		})
+	}
+	adaptersStopped := make(chan struct{})
+	go func() {
+		adaptersRunning.Wait()
+		close(adaptersStopped)
+	}()
+
+	group.Go(func() error {
+		streamGroup, sCtx := errgroup.WithContext(gCtx)
+		for _, streamCfg := range streams {
+			adapter := streamAdapters[streamCfg.Name]
+			logger.Log.Info("starting stream", zap.String("stream", streamCfg.Name), zap.Int("count", streamCfg.Count))
+			for range streamCfg.Count {
+				streamGroup.Go(func() error {
+					chainWatchStream, err := stream.NewChainWatchStream(sCtx, streamCfg.Config)
+					if err != nil {
+						return fmt.Errorf("stream %s: %w", streamCfg.Name, err)
+					}
+					return chainWatchStream.ForwardMessagesToAdapter(sCtx, adapter)
+				})
+			}
+		}
+		err := streamGroup.Wait()
+
+		logger.Log.Info("streams stopped, shutting down adapters", zap.Duration("shutdown_timeout", cfg.ShutdownTimeout))
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		stopAdapters(shutdownCtx, adapters, cancelAdapters, adaptersStopped)
+
+		return err
+	})
+
+	if err := group.Wait(); err != nil && !errors.Is(err, context.Canceled) {
 		logger.Log.Fatal("error running streams", zap.Error(err))
 	}
+	logger.Log.Info("shutdown complete")
 }
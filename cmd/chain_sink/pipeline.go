@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/blockdaemon/chain_sink/pkg/clock"
+	"github.com/blockdaemon/chain_sink/pkg/logger"
+	"github.com/blockdaemon/chain_sink/pkg/pipeline"
+	"github.com/blockdaemon/chain_sink/pkg/processors/dedup"
+	"github.com/blockdaemon/chain_sink/pkg/processors/filter"
+	"github.com/blockdaemon/chain_sink/pkg/processors/schema"
+	"github.com/blockdaemon/chain_sink/pkg/processors/transform"
+	"github.com/blockdaemon/chain_sink/pkg/ratelimit"
+	"github.com/blockdaemon/chain_sink/pkg/reorder"
+	"github.com/blockdaemon/chain_sink/pkg/stream"
+	"github.com/mcuadros/go-defaults"
+	"go.uber.org/zap"
+)
+
+// buildProcessor builds a processor for the pipeline, which consumes the source stream. getAdapter returns the named
+// adapters processors hand messages to.
+func buildProcessor(ctx context.Context, cfg ProcessorConfig, pipelineName string, source StreamConfig, getAdapter func(name string) (stream.Adapter, error)) (pipeline.Processor, error) {
+	switch cfg.Type {
+	case ProcessorTypeFilter:
+		if cfg.Filter == nil {
+			return nil, fmt.Errorf("filter config is required")
+		}
+		return filter.New(*cfg.Filter)
+	case ProcessorTypeTransform:
+		if cfg.Transform == nil {
+			return nil, fmt.Errorf("transform config is required")
+		}
+		return transform.New(*cfg.Transform, source.TargetId(), clock.Real)
+	case ProcessorTypeDedup:
+		if cfg.Dedup == nil {
+			cfg.Dedup = new(dedup.Config)
+			defaults.SetDefaults(cfg.Dedup)
+		}
+		return dedup.New(*cfg.Dedup, pipelineName, clock.Real)
+	case ProcessorTypeSchema:
+		if cfg.Schema == nil {
+			return nil, fmt.Errorf("schema config is required")
+		}
+		var quarantine stream.Adapter
+		if cfg.Schema.Quarantine != "" {
+			var err error
+			if quarantine, err = getAdapter(cfg.Schema.Quarantine); err != nil {
+				return nil, fmt.Errorf("quarantine: %w", err)
+			}
+		}
+		return schema.New(*cfg.Schema, pipelineName, quarantine)
+	}
+	return nil, fmt.Errorf("unsupported processor type: %s", cfg.Type)
+}
+
+// buildPipelines builds the pipelines and the adapters they use as sinks, only adapters that are used by a pipeline
+// are built. It returns the adapter for every stream keyed by stream name, and every pipeline and adapter that was
+// built, with the reorder buffers before the pipelines before their sinks so they are flushed first on shutdown.
+func buildPipelines(ctx context.Context, cfg Config) (map[string]stream.Adapter, []stream.Adapter, error) {
+	adapterConfigs := cfg.AdapterConfigs()
+	streams := make(map[string]StreamConfig)
+	for _, s := range cfg.StreamConfigs() {
+		streams[s.Name] = s
+		if s.Adapter != nil {
+			adapterConfigs[streamAdapterName(s.Name)] = *s.Adapter
+		}
+	}
+
+	var globalLimiter *ratelimit.RateLimiter
+	if cfg.RateLimit != nil && cfg.RateLimit.Enabled() {
+		globalLimiter = ratelimit.New("global", *cfg.RateLimit)
+	}
+
+	sinks := make(map[string]stream.Adapter)
+	var sinkOrder []stream.Adapter
+	getSink := func(name string) (stream.Adapter, error) {
+		if sink, ok := sinks[name]; ok {
+			return sink, nil
+		}
+		adapterCfg, ok := adapterConfigs[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown adapter: %s", name)
+		}
+		sink, err := buildAdapter(ctx, name, adapterCfg, globalLimiter)
+		if err != nil {
+			return nil, fmt.Errorf("adapter %s: %w", name, err)
+		}
+		sinks[name] = sink
+		sinkOrder = append(sinkOrder, sink)
+		return sink, nil
+	}
+
+	streamAdapters := make(map[string]stream.Adapter)
+	var reorderers, pipelines []stream.Adapter
+	for _, p := range cfg.PipelineConfigs() {
+		pipelineSinks := make([]stream.Adapter, 0, len(p.Sinks))
+		for _, name := range p.Sinks {
+			sink, err := getSink(name)
+			if err != nil {
+				return nil, nil, fmt.Errorf("pipeline %s: %w", p.Name, err)
+			}
+			// In ack mode Chain Watch sends the next message only after the previous one was acknowledged, so every
+			// transaction holds a single message and waits max_latency.
+			if kafkaCfg := adapterConfigs[name].Kafka; kafkaCfg != nil && kafkaCfg.Producer.Transactions.Enabled && streams[p.Source].Mode == stream.StreamModeAck {
+				logger.Log.Warn("kafka transactions with an ack mode stream commit every message after max_latency", zap.String("pipeline", p.Name), zap.String("source", p.Source), zap.String("adapter", name))
+			}
+			pipelineSinks = append(pipelineSinks, sink)
+		}
+
+		processors := make([]pipeline.Processor, 0, len(p.Processors))
+		for _, processorCfg := range p.Processors {
+			processor, err := buildProcessor(ctx, processorCfg, p.Name, streams[p.Source], getSink)
+			if err != nil {
+				return nil, nil, fmt.Errorf("pipeline %s: %w", p.Name, err)
+			}
+			processors = append(processors, processor)
+		}
+
+		// A pipeline that only forwards to a single sink is the sink itself.
+		var adapter stream.Adapter
+		if len(processors) == 0 && len(pipelineSinks) == 1 {
+			adapter = pipelineSinks[0]
+		} else {
+			logger.Log.Info("built pipeline", zap.String("pipeline", p.Name), zap.String("source", p.Source), zap.Int("processors", len(processors)), zap.Strings("sinks", p.Sinks))
+			built := pipeline.New(p.Name, processors, pipelineSinks)
+			pipelines = append(pipelines, built)
+			adapter = built
+		}
+
+		// The events are reordered before they are processed.
+		if p.Reorder != nil {
+			reorderer := reorder.New(*p.Reorder, adapter, clock.Real)
+			reorderers = append(reorderers, reorderer)
+			adapter = reorderer
+		}
+
+		streamAdapters[p.Source] = adapter
+	}
+
+	adapters := append(reorderers, pipelines...)
+	return streamAdapters, append(adapters, sinkOrder...), nil
+}
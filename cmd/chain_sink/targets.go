@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/blockdaemon/chain_sink/pkg/chainwatch"
+)
+
+const targetsUsage = `Usage: chain_sink targets <command> [flags] [target id]
+
+Manages Chain Watch targets. The API key and url are taken from the first configured stream unless given as flags.
+
+Commands:
+  list     List the targets
+  create   Create a target, --write-config prints a stream configuration for it
+  get      Print a target
+  update   Update the name, description, mode or buffer size of a target
+  delete   Delete a target
+  status   Print the status and buffer usage of a target
+`
+
+// targetsOptions are the flags shared by the targets commands.
+type targetsOptions struct {
+	apiURL      string
+	apiKey      string
+	configFiles configFiles
+}
+
+func newTargetsFlagSet(name string) (*flag.FlagSet, *targetsOptions) {
+	flags := flag.NewFlagSet("targets "+name, flag.ContinueOnError)
+	flags.SetOutput(os.Stderr)
+	options := new(targetsOptions)
+	flags.StringVar(&options.apiURL, "api-url", "", "Chain Watch API url, derived from the stream url by default")
+	flags.StringVar(&options.apiKey, "api-key", "", "Chain Watch API key, the stream's api_key by default")
+	flags.Var(&options.configFiles, "config", "Config file, can be repeated, BD_CONFIG_FILES is used if not given")
+	return flags, options
+}
+
+// client creates a client, the API url and key that were not given as flags are taken from the config.
+func (o *targetsOptions) client() (*chainwatch.Client, error) {
+	if o.apiURL == "" || o.apiKey == "" {
+		cfg, err := LoadConfig(o.configFiles...)
+		if err != nil && o.apiKey == "" {
+			return nil, fmt.Errorf("no API key: use --api-key or configure the stream's api_key: %w", err)
+		}
+		if err == nil {
+			if streams := cfg.StreamConfigs(); len(streams) > 0 {
+				if o.apiKey == "" {
+					o.apiKey = streams[0].ApiKey
+				}
+				if o.apiURL == "" {
+					o.apiURL, _ = chainwatch.APIURLFromWebsocketURL(streams[0].URL)
+				}
+			}
+		}
+	}
+	if o.apiURL == "" {
+		o.apiURL = chainwatch.DefaultAPIURL
+	}
+	return chainwatch.NewClient(o.apiURL, o.apiKey), nil
+}
+
+// runTargets runs the targets command with the arguments following "targets", the output is written to stdout.
+func runTargets(ctx context.Context, args []string, stdout io.Writer) error {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		fmt.Fprint(stdout, targetsUsage)
+		return nil
+	}
+
+	command, args := args[0], args[1:]
+	switch command {
+	case "list":
+		return runTargetsList(ctx, args, stdout)
+	case "create":
+		return runTargetsCreate(ctx, args, stdout)
+	case "get":
+		return runTargetsGet(ctx, args, stdout)
+	case "update":
+		return runTargetsUpdate(ctx, args, stdout)
+	case "delete":
+		return runTargetsDelete(ctx, args, stdout)
+	case "status":
+		return runTargetsStatus(ctx, args, stdout)
+	}
+	return fmt.Errorf("unknown targets command %q\n\n%s", command, targetsUsage)
+}
+
+// parseTargetArgs parses the flags and returns the target id, which is the only positional argument.
+func parseTargetArgs(flags *flag.FlagSet, args []string) (string, error) {
+	if err := flags.Parse(args); err != nil {
+		return "", err
+	}
+	if flags.NArg() != 1 {
+		return "", fmt.Errorf("expected a target id: chain_sink %s [flags] <target id>", flags.Name())
+	}
+	return flags.Arg(0), nil
+}
+
+func runTargetsList(ctx context.Context, args []string, stdout io.Writer) error {
+	flags, options := newTargetsFlagSet("list")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	client, err := options.client()
+	if err != nil {
+		return err
+	}
+
+	targets, err := client.ListTargets(ctx)
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tNAME\tTYPE\tMODE\tSTATUS\tBUFFER")
+	for _, target := range targets {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%d/%d\n", target.Id, target.Name, target.Type, target.Settings.Mode,
+			target.Status, target.CurrentBufferCount, target.MaxBufferCount)
+	}
+	return writer.Flush()
+}
+
+func runTargetsCreate(ctx context.Context, args []string, stdout io.Writer) error {
+	flags, options := newTargetsFlagSet("create")
+	target := chainwatch.Target{}
+	var mode string
+	var writeConfig bool
+	flags.StringVar(&target.Name, "name", "", "Target name, required")
+	flags.StringVar(&target.Description, "description", "", "Target description")
+	flags.StringVar(&target.Type, "type", "websocket", "Target type")
+	flags.StringVar(&mode, "mode", string(chainwatch.TargetModeAck), "Target mode, ack or noack")
+	flags.IntVar(&target.MaxBufferCount, "max-buffer-count", 100, "Maximum number of buffered messages")
+	flags.BoolVar(&writeConfig, "write-config", false, "Print a stream configuration for the target instead of the target")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if target.Name == "" {
+		return errors.New("--name is required")
+	}
+	if err := checkTargetMode(mode); err != nil {
+		return err
+	}
+	target.Settings.Mode = chainwatch.TargetMode(mode)
+
+	client, err := options.client()
+	if err != nil {
+		return err
+	}
+
+	created, err := client.CreateTarget(ctx, target)
+	if err != nil {
+		return err
+	}
+
+	if writeConfig {
+		return writeStreamConfig(stdout, created, options)
+	}
+	return writeJSON(stdout, created)
+}
+
+func checkTargetMode(mode string) error {
+	switch chainwatch.TargetMode(mode) {
+	case chainwatch.TargetModeAck, chainwatch.TargetModeNoAck:
+		return nil
+	}
+	return fmt.Errorf("invalid mode %q: expected %s or %s", mode, chainwatch.TargetModeAck, chainwatch.TargetModeNoAck)
+}
+
+// writeStreamConfig prints a stream configuration block for the target.
+func writeStreamConfig(stdout io.Writer, target *chainwatch.Target, options *targetsOptions) error {
+	fmt.Fprintln(stdout, "stream:")
+	fmt.Fprintf(stdout, "  url: %q\n", target.WebsocketURL(options.apiURL))
+	fmt.Fprintf(stdout, "  mode: %q\n", target.Settings.Mode)
+	if options.apiKey != "" {
+		fmt.Fprintf(stdout, "  api_key: %q\n", options.apiKey)
+	}
+	return nil
+}
+
+func runTargetsGet(ctx context.Context, args []string, stdout io.Writer) error {
+	flags, options := newTargetsFlagSet("get")
+	id, err := parseTargetArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	client, err := options.client()
+	if err != nil {
+		return err
+	}
+
+	target, err := client.GetTarget(ctx, id)
+	if err != nil {
+		return err
+	}
+	return writeJSON(stdout, target)
+}
+
+func runTargetsUpdate(ctx context.Context, args []string, stdout io.Writer) error {
+	flags, options := newTargetsFlagSet("update")
+	var name, description, mode string
+	var maxBufferCount int
+	flags.StringVar(&name, "name", "", "Target name")
+	flags.StringVar(&description, "description", "", "Target description")
+	flags.StringVar(&mode, "mode", "", "Target mode, ack or noack")
+	flags.IntVar(&maxBufferCount, "max-buffer-count", 0, "Maximum number of buffered messages")
+	id, err := parseTargetArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if mode != "" {
+		if err := checkTargetMode(mode); err != nil {
+			return err
+		}
+	}
+	client, err := options.client()
+	if err != nil {
+		return err
+	}
+
+	target, err := client.GetTarget(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	// Only the given flags are changed.
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "name":
+			target.Name = name
+		case "description":
+			target.Description = description
+		case "mode":
+			target.Settings.Mode = chainwatch.TargetMode(mode)
+		case "max-buffer-count":
+			target.MaxBufferCount = maxBufferCount
+		}
+	})
+
+	updated, err := client.UpdateTarget(ctx, *target)
+	if err != nil {
+		return err
+	}
+	return writeJSON(stdout, updated)
+}
+
+func runTargetsDelete(ctx context.Context, args []string, stdout io.Writer) error {
+	flags, options := newTargetsFlagSet("delete")
+	id, err := parseTargetArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	client, err := options.client()
+	if err != nil {
+		return err
+	}
+
+	if err := client.DeleteTarget(ctx, id); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "deleted target %s\n", id)
+	return nil
+}
+
+func runTargetsStatus(ctx context.Context, args []string, stdout io.Writer) error {
+	flags, options := newTargetsFlagSet("status")
+	id, err := parseTargetArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	client, err := options.client()
+	if err != nil {
+		return err
+	}
+
+	target, err := client.GetTarget(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(writer, "id:\t%s\n", target.Id)
+	fmt.Fprintf(writer, "name:\t%s\n", target.Name)
+	fmt.Fprintf(writer, "mode:\t%s\n", target.Settings.Mode)
+	if target.StatusSince != nil {
+		fmt.Fprintf(writer, "status:\t%s since %s\n", target.Status, target.StatusSince.Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(writer, "status:\t%s\n", target.Status)
+	}
+	fmt.Fprintf(writer, "buffer:\t%d/%d\n", target.CurrentBufferCount, target.MaxBufferCount)
+	return writer.Flush()
+}
+
+func writeJSON(stdout io.Writer, value any) error {
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
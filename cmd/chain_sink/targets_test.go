@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/blockdaemon/chain_sink/pkg/chainwatch"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTargetsAPI is an in memory stand-in for the Chain Watch targets API.
+type fakeTargetsAPI struct {
+	sync.Mutex
+	targets map[string]chainwatch.Target
+	nextId  int
+}
+
+func (a *fakeTargetsAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.Lock()
+	defer a.Unlock()
+
+	if r.Header.Get("x-api-key") != "test-key" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/targets/")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/targets":
+		targets := make([]chainwatch.Target, 0, len(a.targets))
+		for _, target := range a.targets {
+			targets = append(targets, target)
+		}
+		_ = json.NewEncoder(w).Encode(targets)
+	case r.Method == http.MethodPost && r.URL.Path == "/targets":
+		var target chainwatch.Target
+		_ = json.NewDecoder(r.Body).Decode(&target)
+		a.nextId++
+		target.Id = fmt.Sprintf("target-%d", a.nextId)
+		target.Status = "active"
+		a.targets[target.Id] = target
+		_ = json.NewEncoder(w).Encode(target)
+	case r.Method == http.MethodGet:
+		target, ok := a.targets[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(target)
+	case r.Method == http.MethodPut:
+		existing, ok := a.targets[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var target chainwatch.Target
+		_ = json.NewDecoder(r.Body).Decode(&target)
+		target.Id, target.Status, target.CurrentBufferCount = id, existing.Status, existing.CurrentBufferCount
+		a.targets[id] = target
+		_ = json.NewEncoder(w).Encode(target)
+	case r.Method == http.MethodDelete:
+		delete(a.targets, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func runTargetsCommand(t *testing.T, serverURL string, args ...string) (string, error) {
+	t.Helper()
+	var stdout bytes.Buffer
+	command, rest := args[0], args[1:]
+	err := runTargets(context.Background(), append([]string{command, "--api-url", serverURL, "--api-key", "test-key"}, rest...), &stdout)
+	return stdout.String(), err
+}
+
+func TestRunTargets(t *testing.T) {
+	api := &fakeTargetsAPI{targets: make(map[string]chainwatch.Target)}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	output, err := runTargetsCommand(t, server.URL, "create", "--name", "quick start", "--mode", "noack", "--write-config")
+	require.NoError(t, err)
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	assert.Equal(t, fmt.Sprintf("stream:\n  url: %q\n  mode: \"noack\"\n  api_key: \"test-key\"\n", wsURL+"/targets/target-1/websocket"), output)
+	assert.Equal(t, chainwatch.Target{Id: "target-1", Name: "quick start", Type: "websocket", MaxBufferCount: 100,
+		Settings: chainwatch.TargetSettings{Mode: chainwatch.TargetModeNoAck}, Status: "active"}, api.targets["target-1"])
+
+	output, err = runTargetsCommand(t, server.URL, "list")
+	require.NoError(t, err)
+	assert.Equal(t, "ID        NAME         TYPE       MODE   STATUS  BUFFER\ntarget-1  quick start  websocket  noack  active  0/100\n", output)
+
+	output, err = runTargetsCommand(t, server.URL, "update", "--mode", "ack", "target-1")
+	require.NoError(t, err)
+	var updated chainwatch.Target
+	require.NoError(t, json.Unmarshal([]byte(output), &updated))
+	assert.Equal(t, chainwatch.TargetModeAck, updated.Settings.Mode)
+	assert.Equal(t, "quick start", updated.Name, "fields without a flag are kept")
+
+	output, err = runTargetsCommand(t, server.URL, "status", "target-1")
+	require.NoError(t, err)
+	assert.Equal(t, "id:      target-1\nname:    quick start\nmode:    ack\nstatus:  active\nbuffer:  0/100\n", output)
+
+	output, err = runTargetsCommand(t, server.URL, "delete", "target-1")
+	require.NoError(t, err)
+	assert.Equal(t, "deleted target target-1\n", output)
+
+	_, err = runTargetsCommand(t, server.URL, "get", "target-1")
+	assert.True(t, chainwatch.IsNotFound(err))
+}
+
+func TestRunTargets_errors(t *testing.T) {
+	server := httptest.NewServer(&fakeTargetsAPI{targets: make(map[string]chainwatch.Target)})
+	defer server.Close()
+
+	_, err := runTargetsCommand(t, server.URL, "create")
+	assert.EqualError(t, err, "--name is required")
+
+	_, err = runTargetsCommand(t, server.URL, "create", "--name", "a", "--mode", "sometimes")
+	assert.EqualError(t, err, `invalid mode "sometimes": expected ack or noack`)
+
+	_, err = runTargetsCommand(t, server.URL, "get")
+	assert.EqualError(t, err, "expected a target id: chain_sink targets get [flags] <target id>")
+
+	err = runTargets(context.Background(), []string{"rename"}, &bytes.Buffer{})
+	assert.ErrorContains(t, err, `unknown targets command "rename"`)
+}
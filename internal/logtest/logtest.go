@@ -0,0 +1,21 @@
+// Package logtest captures the global logger in tests.
+package logtest
+
+import (
+	"testing"
+
+	"github.com/blockdaemon/chain_sink/pkg/logger"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest"
+)
+
+// Capture replaces the global logger with one that writes JSON at debug level to the returned buffer, the previous
+// logger is restored when the test ends. Loggers derived from the global logger before are not captured.
+func Capture(t testing.TB) *zaptest.Buffer {
+	logs := &zaptest.Buffer{}
+	previous := logger.Log
+	logger.Log = zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.Lock(logs), zapcore.DebugLevel))
+	t.Cleanup(func() { logger.Log = previous })
+	return logs
+}
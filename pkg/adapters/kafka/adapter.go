@@ -6,25 +6,44 @@ import (
 	"strings"
 
 	"github.com/blockdaemon/chain_sink/pkg/logger"
+	"github.com/blockdaemon/chain_sink/pkg/schemaregistry"
 	"github.com/blockdaemon/chain_sink/pkg/stream"
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
 	"github.com/google/uuid"
+	"github.com/valyala/fastjson"
 	"go.uber.org/zap"
 )
 
-var _ stream.Adapter = (*KafkaAdapter)(nil)
+var _ stream.AsyncAdapter = (*KafkaAdapter)(nil)
+var _ stream.Lifecycle = (*KafkaAdapter)(nil)
+
+var parserPool = fastjson.ParserPool{}
 
 type KafkaAdapter struct {
-	producer *kafka.Producer
-	topic    string
+	producer  *kafka.Producer
+	topic     string
+	keySource KeySource
+
+	transactions *transactions
+	serializer   schemaregistry.Serializer
 }
 
+// NewKafkaAdapter creates a new producer. The producer is idempotent with acks=all by default, which can be disabled
+// using the config or overridden by the passed options.
 func NewKafkaAdapter(cfg ProducerConfig, opts ...ClientOption) (*KafkaAdapter, error) {
 	clientConfig := kafka.ConfigMap{
 		clientOptBootstrapServers: strings.Join(cfg.Brokers, ","),
 	}
 
-	for _, opt := range opts {
+	var defaultOpts []ClientOption
+	if !cfg.DisableIdempotence || cfg.Transactions.Enabled {
+		defaultOpts = append(defaultOpts, UseIdempotence())
+	}
+	if cfg.Transactions.Enabled {
+		defaultOpts = append(defaultOpts, UseTransactionalID(cfg.Transactions.TransactionalID))
+	}
+
+	for _, opt := range append(defaultOpts, opts...) {
 		if err := opt(clientConfig); err != nil {
 			return nil, fmt.Errorf("error applying client option: %w", err)
 		}
@@ -35,28 +54,65 @@ func NewKafkaAdapter(cfg ProducerConfig, opts ...ClientOption) (*KafkaAdapter, e
 		return nil, err
 	}
 
-	return &KafkaAdapter{
-		producer: producer,
-		topic:    cfg.Topic,
-	}, nil
+	adapter := &KafkaAdapter{
+		producer:  producer,
+		topic:     cfg.Topic,
+		keySource: cfg.KeySource,
+	}
+
+	if cfg.Serializer.Enabled() {
+		adapter.serializer, err = schemaregistry.NewSerializer(context.Background(), cfg.Serializer, cfg.Topic)
+		if err != nil {
+			producer.Close()
+			return nil, fmt.Errorf("error creating serializer: %w", err)
+		}
+	}
+
+	if cfg.Transactions.Enabled {
+		adapter.transactions, err = newTransactions(producer, cfg.Transactions)
+		if err != nil {
+			producer.Close()
+			return nil, fmt.Errorf("error initializing transactions: %w", err)
+		}
+	}
+
+	return adapter, nil
 }
 
-func (p *KafkaAdapter) Run(ctx context.Context) error {
+// Start handles the producer events until ctx is cancelled. Delivery reports of messages produced by
+// HandleMessageAsync are handled here, so it must be running while messages are produced.
+func (p *KafkaAdapter) Start(ctx context.Context) error {
 	events := p.producer.Events()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case event := <-events:
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
 			switch e := event.(type) {
 			case *kafka.Message:
+				// Messages produced by HandleMessageAsync carry their completion callback.
+				if done, ok := e.Opaque.(func(error)); ok {
+					done(e.TopicPartition.Error)
+					continue
+				}
 				if e.TopicPartition.Error != nil {
+					// In transactional mode failed deliveries fail the commit, which is reported to the waiting messages.
+					if p.transactions != nil {
+						logger.Log.Warn("Transactional message delivery failed", zap.Error(e.TopicPartition.Error))
+						continue
+					}
 					return e.TopicPartition.Error
 				}
 				logger.Log.Debug("Message sent", zap.String("topic", *e.TopicPartition.Topic), zap.Int32("partition", e.TopicPartition.Partition), zap.Int64("offset", int64(e.TopicPartition.Offset)))
 
 			case kafka.Error:
+				if e.IsFatal() {
+					return e
+				}
 				// These are considered non-fatal errors which are retried automatically. Might drop to debug level later.
 				logger.Log.Error("Kafka error", zap.Error(e))
 			}
@@ -65,17 +121,17 @@ func (p *KafkaAdapter) Run(ctx context.Context) error {
 }
 
 func (p *KafkaAdapter) HandleMessage(ctx context.Context, message []byte) error {
-	deliveries := make(chan kafka.Event)
+	kafkaMessage, err := p.newMessage(message)
+	if err != nil {
+		return err
+	}
 
-	// random uuid as key
-	// TODO: reassess this strategy later
-	key := uuid.New().String()
+	if p.transactions != nil {
+		return p.transactions.produce(ctx, kafkaMessage)
+	}
 
-	if err := p.producer.Produce(&kafka.Message{
-		Value:          message,
-		Key:            []byte(key),
-		TopicPartition: kafka.TopicPartition{Topic: &p.topic, Partition: kafka.PartitionAny},
-	}, deliveries); err != nil {
+	deliveries := make(chan kafka.Event)
+	if err := p.producer.Produce(kafkaMessage, deliveries); err != nil {
 		return err
 	}
 
@@ -121,22 +177,112 @@ func (p *KafkaAdapter) HandleMessage(ctx context.Context, message []byte) error
 			return nil
 		}
 		if err2 == nil {
-			logger.Log.Debug("Message delivered to kafka", zap.String("topic", p.topic), zap.String("key", key))
+			logger.Log.Debug("Message delivered to kafka", zap.String("topic", p.topic), zap.ByteString("key", kafkaMessage.Key))
 		}
 		return err2
 	}
 }
 
-func (p *KafkaAdapter) Close() error {
+// HandleMessageAsync produces the message without waiting for the delivery report. The delivery report is handled
+// by Start, which calls done, so Start must be running for messages to complete.
+func (p *KafkaAdapter) HandleMessageAsync(ctx context.Context, message []byte, done func(error)) error {
+	kafkaMessage, err := p.newMessage(message)
+	if err != nil {
+		return err
+	}
+
+	if p.transactions != nil {
+		txn, err := p.transactions.add(ctx, kafkaMessage)
+		if err != nil {
+			return err
+		}
+		go func() {
+			<-txn.done
+			done(txn.err)
+		}()
+		return nil
+	}
+
+	kafkaMessage.Opaque = done
+	return p.producer.Produce(kafkaMessage, nil)
+}
+
+func (p *KafkaAdapter) newMessage(message []byte) (*kafka.Message, error) {
+	key, err := p.messageKey(message)
+	if err != nil {
+		return nil, err
+	}
+
+	value := message
+	if p.serializer != nil {
+		if value, err = p.serializer.Serialize(message); err != nil {
+			return nil, fmt.Errorf("error serializing message: %w", err)
+		}
+	}
+
+	return &kafka.Message{
+		Value:          value,
+		Key:            key,
+		TopicPartition: kafka.TopicPartition{Topic: &p.topic, Partition: kafka.PartitionAny},
+	}, nil
+}
+
+func (p *KafkaAdapter) messageKey(message []byte) ([]byte, error) {
+	if p.keySource != KeySourceMessageId {
+		return []byte(uuid.New().String()), nil
+	}
+
+	parser := parserPool.Get()
+	defer parserPool.Put(parser)
+
+	parsed, err := parser.ParseBytes(message)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing message for key: %w", err)
+	}
+
+	id := parsed.Get("id")
+	if id == nil {
+		return nil, fmt.Errorf("message id is required to use it as key")
+	}
+
+	// string ids are used without quotes, anything else is used in its json representation.
+	if idBytes, err := id.StringBytes(); err == nil {
+		return append([]byte(nil), idBytes...), nil
+	}
+	return id.MarshalTo(nil), nil
+}
+
+// Flush commits the open transaction, if any, and waits until all produced messages are delivered or ctx is done.
+func (p *KafkaAdapter) Flush(ctx context.Context) error {
 	if p.producer.IsClosed() {
 		return nil
 	}
 
-	p.producer.Close()
-	outstandingMessages := p.producer.Flush(30 * 1000)
-	if outstandingMessages > 0 {
-		logger.Log.Warn("Failed to send all messages", zap.Int("outstanding_messages", outstandingMessages))
+	if p.transactions != nil {
+		p.transactions.flush()
 	}
 
+	for {
+		outstanding := p.producer.Flush(100)
+		if outstanding == 0 {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("failed to deliver %d outstanding messages: %w", outstanding, ctx.Err())
+		}
+	}
+}
+
+// Close aborts the open transaction, if any, and closes the producer. Messages that are not flushed are lost.
+func (p *KafkaAdapter) Close(_ context.Context) error {
+	if p.producer.IsClosed() {
+		return nil
+	}
+
+	if p.transactions != nil {
+		p.transactions.close()
+	}
+
+	p.producer.Close()
 	return nil
 }
@@ -0,0 +1,28 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKafkaAdapter_messageKey(t *testing.T) {
+	adapter := &KafkaAdapter{keySource: KeySourceMessageId}
+
+	key, err := adapter.messageKey([]byte(`{"id":"test-message-one","type":"greeting"}`))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("test-message-one"), key)
+
+	key, err = adapter.messageKey([]byte(`{"id":42}`))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("42"), key)
+
+	_, err = adapter.messageKey([]byte(`{"type":"greeting"}`))
+	assert.Error(t, err)
+
+	adapter.keySource = KeySourceRandom
+	key, err = adapter.messageKey([]byte(`not json`))
+	require.NoError(t, err)
+	assert.Len(t, key, 36)
+}
@@ -3,6 +3,7 @@ package kafka
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/blockdaemon/chain_sink/pkg/logger"
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
@@ -11,6 +12,7 @@ import (
 
 type Administrator interface {
 	CreateTopicIfNotExists(ctx context.Context, topicName string, numPartitions, replicationFactor int, opts ...TopicOption) (bool, error)
+	ReconcileTopic(ctx context.Context, mode TopicReconcileMode, topicName string, numPartitions int, opts ...TopicOption) (TopicDrift, error)
 }
 
 var _ Administrator = (*AdminClient)(nil)
@@ -45,6 +47,35 @@ func NewAdminClient(host string, opts ...ClientOption) (*AdminClient, error) {
 	}, nil
 }
 
+// TopicExists reports whether the topic exists, it returns an error if the brokers can not be reached.
+func (k *AdminClient) TopicExists(ctx context.Context, topicName string) (bool, error) {
+	timeout := 60000
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = int(time.Until(deadline).Milliseconds())
+	}
+
+	meta, err := k.client.GetMetadata(&topicName, false, timeout)
+	if err != nil {
+		return false, fmt.Errorf("error retrieving topic metadata: %w", err)
+	}
+
+	result, ok := meta.Topics[topicName]
+	if !ok {
+		return false, nil
+	}
+	switch result.Error.Code() {
+	case kafka.ErrNoError:
+		return true, nil
+	case kafka.ErrUnknownTopic, kafka.ErrUnknownTopicOrPart:
+		return false, nil
+	}
+	return false, fmt.Errorf("error retrieving topic metadata for %s: %w", topicName, result.Error)
+}
+
+func (k *AdminClient) Close() {
+	k.client.Close()
+}
+
 // CreateTopicIfNotExists creates a topic if it does not exist yet. This will return true if the topic is created. If it returns false and no error the topic
 // already existed and no operation was performed.
 // NOTE: In order to create a topic with this function you need both `DESCRIBE` and `CREATE` ACL privileges on either the cluster level, or on the topic level.
@@ -2,7 +2,9 @@ package kafka
 
 import (
 	"fmt"
+	"time"
 
+	"github.com/blockdaemon/chain_sink/pkg/schemaregistry"
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
 )
 
@@ -25,6 +27,11 @@ const (
 	clientOptAutoOffsetReset             = "auto.offset.reset"
 	clientOptEnableAutoOffsetStore       = "enable.auto.offset.store"
 	clientOptEnableAutoCommit            = "enable.auto.commit"
+	clientOptEnableIdempotence           = "enable.idempotence"
+	clientOptAcks                        = "acks"
+	clientOptTransactionalID             = "transactional.id"
+
+	optAcksAll = "all"
 )
 
 type AuthenticationType string
@@ -37,7 +44,7 @@ const (
 type Authentication struct {
 	Type     AuthenticationType `mapstructure:"type" validate:"oneof='' none sasl_ssl" default:"none"`
 	Username string             `mapstructure:"username"`
-	Password string             `mapstructure:"password"`
+	Password string             `mapstructure:"password" secret:"true"`
 }
 
 func (a *Authentication) BuildOptions() ([]ClientOption, error) {
@@ -50,9 +57,33 @@ func (a *Authentication) BuildOptions() ([]ClientOption, error) {
 	return nil, fmt.Errorf("unsupported authentication type: %s", a.Type)
 }
 
+type KeySource string
+
+const (
+	// KeySourceRandom uses a random uuid as message key.
+	KeySourceRandom KeySource = "random"
+	// KeySourceMessageId uses the Chain Watch message id as message key, so redeliveries end up on the same partition.
+	KeySourceMessageId KeySource = "message_id"
+)
+
 type ProducerConfig struct {
-	Brokers []string `mapstructure:"brokers"`
-	Topic   string   `mapstructure:"topic"`
+	Brokers            []string          `mapstructure:"brokers"`
+	Topic              string            `mapstructure:"topic"`
+	KeySource          KeySource         `mapstructure:"key_source" default:"random" validate:"oneof=random message_id"`
+	DisableIdempotence bool              `mapstructure:"disable_idempotence"`
+	Transactions       TransactionConfig `mapstructure:"transactions"`
+	// Serializer optionally converts messages into a Schema Registry wire format before producing.
+	Serializer schemaregistry.Config `mapstructure:"serializer"`
+}
+
+// TransactionConfig configures the transactional producer mode. When enabled, messages are grouped into a single
+// Kafka transaction and HandleMessage only returns once the transaction containing the message has been committed.
+type TransactionConfig struct {
+	Enabled         bool          `mapstructure:"enabled"`
+	TransactionalID string        `mapstructure:"transactional_id" validate:"required_if=Enabled true"`
+	MaxMessages     int           `mapstructure:"max_messages" default:"100" validate:"gte=0"`
+	MaxLatency      time.Duration `mapstructure:"max_latency" default:"100ms" validate:"gte=0"`
+	CommitTimeout   time.Duration `mapstructure:"commit_timeout" default:"30s" validate:"gte=0"`
 }
 
 type ClientOption func(kafka.ConfigMap) error
@@ -88,6 +119,23 @@ func UseSaslPlain(username, password string) ClientOption {
 	}
 }
 
+// Enable the idempotent producer, this requires all in-sync replicas to acknowledge a message.
+func UseIdempotence() ClientOption {
+	return func(m kafka.ConfigMap) error {
+		if err := m.SetKey(clientOptEnableIdempotence, true); err != nil {
+			return err
+		}
+		return m.SetKey(clientOptAcks, optAcksAll)
+	}
+}
+
+// Enable the transactional producer using the given transactional id.
+func UseTransactionalID(transactionalID string) ClientOption {
+	return func(m kafka.ConfigMap) error {
+		return m.SetKey(clientOptTransactionalID, transactionalID)
+	}
+}
+
 func WithAutoOffsetCommit() ClientOption {
 	return func(m kafka.ConfigMap) error {
 		return m.SetKey(clientOptEnableAutoCommit, "true")
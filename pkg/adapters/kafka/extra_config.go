@@ -0,0 +1,151 @@
+package kafka
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+// extraConfigKeys is the list of librdkafka properties that may be passed through using extra config.
+// Connection, authentication and TLS properties are deliberately left out, those are managed by the other client
+// options. The properties are applied after the defaults of the producer, so `acks` and `enable.idempotence` override
+// the idempotent producer defaults.
+// See for reference: https://github.com/confluentinc/librdkafka/blob/master/CONFIGURATION.md
+var extraConfigKeys = map[string]struct{}{
+	"acks":                                  {},
+	"api.version.request":                   {},
+	"batch.num.messages":                    {},
+	"batch.size":                            {},
+	"client.id":                             {},
+	"client.rack":                           {},
+	"compression.codec":                     {},
+	"compression.level":                     {},
+	"compression.type":                      {},
+	"connections.max.idle.ms":               {},
+	"debug":                                 {},
+	"delivery.timeout.ms":                   {},
+	"enable.idempotence":                    {},
+	"linger.ms":                             {},
+	"log_level":                             {},
+	"max.in.flight":                         {},
+	"max.in.flight.requests.per.connection": {},
+	"message.max.bytes":                     {},
+	"message.send.max.retries":              {},
+	"message.timeout.ms":                    {},
+	"metadata.max.age.ms":                   {},
+	"partitioner":                           {},
+	"queue.buffering.max.kbytes":            {},
+	"queue.buffering.max.messages":          {},
+	"queue.buffering.max.ms":                {},
+	"reconnect.backoff.max.ms":              {},
+	"reconnect.backoff.ms":                  {},
+	"request.required.acks":                 {},
+	"request.timeout.ms":                    {},
+	"retries":                               {},
+	"retry.backoff.max.ms":                  {},
+	"retry.backoff.ms":                      {},
+	"socket.keepalive.enable":               {},
+	"socket.timeout.ms":                     {},
+	"statistics.interval.ms":                {},
+	"sticky.partitioning.linger.ms":         {},
+	"topic.metadata.refresh.interval.ms":    {},
+	"transaction.timeout.ms":                {},
+}
+
+// WithExtraConfig applies raw librdkafka properties to the client configuration. Nested maps are flattened using dots,
+// so both `linger.ms: 5` and `linger: {ms: 5}` result in the `linger.ms` property. This is required because viper splits
+// configuration keys on dots. Only keys in the list of known-safe properties are accepted.
+func WithExtraConfig(extra map[string]any) ClientOption {
+	return func(m kafka.ConfigMap) error {
+		flattened, err := FlattenExtraConfig(extra)
+		if err != nil {
+			return err
+		}
+
+		for key, value := range flattened {
+			if err := m.SetKey(key, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// FlattenExtraConfig flattens and validates the extra config, returning the librdkafka properties as strings.
+func FlattenExtraConfig(extra map[string]any) (map[string]string, error) {
+	flattened := make(map[string]string)
+	flattenExtraConfig("", extra, flattened)
+
+	var unknown []string
+	for key := range flattened {
+		if _, ok := extraConfigKeys[key]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		messages := make([]string, 0, len(unknown))
+		for _, key := range unknown {
+			if suggestion := suggestExtraConfigKey(key); suggestion != "" {
+				messages = append(messages, fmt.Sprintf("%q (did you mean %q?)", key, suggestion))
+			} else {
+				messages = append(messages, fmt.Sprintf("%q", key))
+			}
+		}
+		return nil, fmt.Errorf("unsupported kafka extra_config keys: %s", strings.Join(messages, ", "))
+	}
+
+	return flattened, nil
+}
+
+func flattenExtraConfig(prefix string, extra map[string]any, out map[string]string) {
+	for key, value := range extra {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+
+		if nested, ok := value.(map[string]any); ok {
+			flattenExtraConfig(key, nested, out)
+			continue
+		}
+
+		out[key] = fmt.Sprint(value)
+	}
+}
+
+// suggestExtraConfigKey returns the closest known key to help out with typos, or an empty string if nothing is close.
+func suggestExtraConfigKey(key string) string {
+	const maxDistance = 3
+
+	best, bestDistance := "", maxDistance+1
+	for known := range extraConfigKeys {
+		if distance := levenshtein(key, known); distance < bestDistance || (distance == bestDistance && known < best) {
+			best, bestDistance = known, distance
+		}
+	}
+	return best
+}
+
+func levenshtein(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
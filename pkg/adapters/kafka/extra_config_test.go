@@ -0,0 +1,40 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlattenExtraConfig(t *testing.T) {
+	flattened, err := FlattenExtraConfig(map[string]any{
+		"linger": map[string]any{"ms": 5},
+		"enable": map[string]any{"idempotence": true},
+		"acks":   "all",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"linger.ms":          "5",
+		"enable.idempotence": "true",
+		"acks":               "all",
+	}, flattened)
+}
+
+func TestFlattenExtraConfig_unknownKeys(t *testing.T) {
+	_, err := FlattenExtraConfig(map[string]any{
+		"linger": map[string]any{"mss": 5},
+		"sasl":   map[string]any{"password": "secret"},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `"linger.mss" (did you mean "linger.ms"?)`)
+	assert.Contains(t, err.Error(), `"sasl.password"`)
+}
+
+func TestWithExtraConfig(t *testing.T) {
+	configMap := kafka.ConfigMap{}
+	err := WithExtraConfig(map[string]any{"linger.ms": 10, "compression": map[string]any{"codec": "zstd"}})(configMap)
+	require.NoError(t, err)
+	assert.Equal(t, kafka.ConfigMap{"linger.ms": "10", "compression.codec": "zstd"}, configMap)
+}
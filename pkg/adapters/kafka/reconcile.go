@@ -0,0 +1,200 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/blockdaemon/chain_sink/pkg/logger"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"go.uber.org/zap"
+)
+
+type TopicReconcileMode string
+
+const (
+	// TopicReconcileModeOff leaves existing topics untouched.
+	TopicReconcileModeOff TopicReconcileMode = "off"
+	// TopicReconcileModeReport logs the drift between the existing topic and the configuration.
+	TopicReconcileModeReport TopicReconcileMode = "report"
+	// TopicReconcileModeDryRun logs the changes that would be applied without applying them.
+	TopicReconcileModeDryRun TopicReconcileMode = "dry_run"
+	// TopicReconcileModeApply alters the topic configuration and increases the partition count to match the configuration.
+	TopicReconcileModeApply TopicReconcileMode = "apply"
+)
+
+// TopicState is the current state of a topic.
+type TopicState struct {
+	NumPartitions int
+	Config        map[string]string
+}
+
+// TopicDrift describes the differences between the current state of a topic and the desired state.
+type TopicDrift struct {
+	Topic string
+	// Partitions is set when the partition count differs.
+	Partitions *PartitionDrift
+	Configs    []ConfigDrift
+}
+
+type PartitionDrift struct {
+	Current int
+	Desired int
+}
+
+type ConfigDrift struct {
+	Name    string
+	Current string
+	Desired string
+}
+
+func (d TopicDrift) HasDrift() bool {
+	return d.Partitions != nil || len(d.Configs) > 0
+}
+
+// CanIncreasePartitions reports whether the partition drift can be resolved, partitions can only be increased.
+func (d TopicDrift) CanIncreasePartitions() bool {
+	return d.Partitions != nil && d.Partitions.Desired > d.Partitions.Current
+}
+
+// DiffTopic compares the current state of a topic with the desired partition count and configuration. Only the
+// configuration entries that are set in the desired configuration are compared.
+func DiffTopic(topicName string, current TopicState, numPartitions int, desiredConfig map[string]string) TopicDrift {
+	drift := TopicDrift{Topic: topicName}
+
+	if numPartitions > 0 && current.NumPartitions != numPartitions {
+		drift.Partitions = &PartitionDrift{Current: current.NumPartitions, Desired: numPartitions}
+	}
+
+	for name, desired := range desiredConfig {
+		if currentValue := current.Config[name]; currentValue != desired {
+			drift.Configs = append(drift.Configs, ConfigDrift{Name: name, Current: currentValue, Desired: desired})
+		}
+	}
+	sort.Slice(drift.Configs, func(i, j int) bool {
+		return drift.Configs[i].Name < drift.Configs[j].Name
+	})
+
+	return drift
+}
+
+// DescribeTopic returns the partition count and configuration of an existing topic.
+// NOTE: This requires `DESCRIBE` and `DESCRIBE_CONFIGS` ACL privileges on the topic.
+func (k *AdminClient) DescribeTopic(ctx context.Context, topicName string) (TopicState, error) {
+	state := TopicState{Config: make(map[string]string)}
+
+	meta, err := k.client.GetMetadata(&topicName, false, 60000)
+	if err != nil {
+		return state, fmt.Errorf("error retrieving topic metadata: %w", err)
+	}
+
+	topic, ok := meta.Topics[topicName]
+	if !ok {
+		return state, fmt.Errorf("topic %s not found", topicName)
+	}
+	if topic.Error.Code() != kafka.ErrNoError {
+		return state, fmt.Errorf("error retrieving topic metadata for %s: %w", topicName, topic.Error)
+	}
+	state.NumPartitions = len(topic.Partitions)
+
+	results, err := k.client.DescribeConfigs(ctx, []kafka.ConfigResource{{Type: kafka.ResourceTopic, Name: topicName}})
+	if err != nil {
+		return state, fmt.Errorf("error describing topic config for %s: %w", topicName, err)
+	}
+
+	for _, result := range results {
+		if result.Error.Code() != kafka.ErrNoError {
+			return state, fmt.Errorf("error describing topic config for %s: %w", topicName, result.Error)
+		}
+		for name, entry := range result.Config {
+			state.Config[name] = entry.Value
+		}
+	}
+
+	return state, nil
+}
+
+// ReconcileTopic compares an existing topic with the desired partition count and topic options, and depending on the
+// mode reports, plans or applies the changes. Partition counts can only be increased, a decrease is always only reported.
+// NOTE: Applying changes requires `ALTER` and `ALTER_CONFIGS` ACL privileges on the topic.
+func (k *AdminClient) ReconcileTopic(ctx context.Context, mode TopicReconcileMode, topicName string, numPartitions int, opts ...TopicOption) (TopicDrift, error) {
+	desiredConfig := make(map[string]string)
+	for _, opt := range opts {
+		opt(desiredConfig)
+	}
+
+	current, err := k.DescribeTopic(ctx, topicName)
+	if err != nil {
+		return TopicDrift{}, err
+	}
+
+	drift := DiffTopic(topicName, current, numPartitions, desiredConfig)
+	if !drift.HasDrift() {
+		logger.Log.Info("kafka topic matches configuration", zap.String("topic", topicName))
+		return drift, nil
+	}
+
+	if drift.Partitions != nil {
+		fields := []zap.Field{zap.String("topic", topicName), zap.Int("current", drift.Partitions.Current), zap.Int("desired", drift.Partitions.Desired)}
+		switch {
+		case !drift.CanIncreasePartitions():
+			logger.Log.Warn("kafka topic partition drift: the partition count can not be decreased", fields...)
+		case mode == TopicReconcileModeReport:
+			logger.Log.Warn("kafka topic partition drift", fields...)
+		case mode == TopicReconcileModeDryRun:
+			logger.Log.Info("dry run: would increase kafka topic partitions", fields...)
+		}
+	}
+
+	for _, config := range drift.Configs {
+		fields := []zap.Field{zap.String("topic", topicName), zap.String("config", config.Name), zap.String("current", config.Current), zap.String("desired", config.Desired)}
+		switch mode {
+		case TopicReconcileModeReport:
+			logger.Log.Warn("kafka topic config drift", fields...)
+		case TopicReconcileModeDryRun:
+			logger.Log.Info("dry run: would alter kafka topic config", fields...)
+		}
+	}
+
+	if mode != TopicReconcileModeApply {
+		return drift, nil
+	}
+
+	return drift, k.applyTopicDrift(ctx, drift)
+}
+
+func (k *AdminClient) applyTopicDrift(ctx context.Context, drift TopicDrift) error {
+	if len(drift.Configs) > 0 {
+		entries := make([]kafka.ConfigEntry, 0, len(drift.Configs))
+		for _, config := range drift.Configs {
+			logger.Log.Info("altering kafka topic config", zap.String("topic", drift.Topic), zap.String("config", config.Name), zap.String("current", config.Current), zap.String("desired", config.Desired))
+			entries = append(entries, kafka.ConfigEntry{Name: config.Name, Value: config.Desired, IncrementalOperation: kafka.AlterConfigOpTypeSet})
+		}
+
+		results, err := k.client.IncrementalAlterConfigs(ctx, []kafka.ConfigResource{{Type: kafka.ResourceTopic, Name: drift.Topic, Config: entries}})
+		if err != nil {
+			return fmt.Errorf("error altering kafka topic config for %s: %w", drift.Topic, err)
+		}
+		for _, result := range results {
+			if result.Error.Code() != kafka.ErrNoError {
+				return fmt.Errorf("result: error altering kafka topic config for %s: %w", drift.Topic, result.Error)
+			}
+		}
+	}
+
+	if drift.CanIncreasePartitions() {
+		logger.Log.Info("increasing kafka topic partitions", zap.String("topic", drift.Topic), zap.Int("current", drift.Partitions.Current), zap.Int("desired", drift.Partitions.Desired))
+
+		results, err := k.client.CreatePartitions(ctx, []kafka.PartitionsSpecification{{Topic: drift.Topic, IncreaseTo: drift.Partitions.Desired}})
+		if err != nil {
+			return fmt.Errorf("error increasing kafka topic partitions for %s: %w", drift.Topic, err)
+		}
+		for _, result := range results {
+			if result.Error.Code() != kafka.ErrNoError {
+				return fmt.Errorf("result: error increasing kafka topic partitions for %s: %w", drift.Topic, result.Error)
+			}
+		}
+	}
+
+	return nil
+}
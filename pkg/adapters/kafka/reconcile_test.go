@@ -0,0 +1,49 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffTopic(t *testing.T) {
+	desired := make(map[string]string)
+	for _, opt := range []TopicOption{
+		SetTopicCompressionType(TopicCompressionTypeZstd),
+		SetTopicRetention("24h"),
+		SetTopicCleanupPolicy("delete"),
+		SetTopicMinInsyncReplicas(2),
+		SetTopicSegmentBytes(0),
+		SetTopicMaxMessageBytes(1048588),
+	} {
+		opt(desired)
+	}
+
+	current := TopicState{
+		NumPartitions: 3,
+		Config: map[string]string{
+			"compression.type":    "producer",
+			"retention.ms":        "86400000",
+			"cleanup.policy":      "delete",
+			"min.insync.replicas": "1",
+			"segment.bytes":       "1073741824",
+			"max.message.bytes":   "1048588",
+		},
+	}
+
+	drift := DiffTopic("events", current, 6, desired)
+	assert.True(t, drift.HasDrift())
+	assert.True(t, drift.CanIncreasePartitions())
+	assert.Equal(t, &PartitionDrift{Current: 3, Desired: 6}, drift.Partitions)
+	assert.Equal(t, []ConfigDrift{
+		{Name: "compression.type", Current: "producer", Desired: "zstd"},
+		{Name: "min.insync.replicas", Current: "1", Desired: "2"},
+	}, drift.Configs)
+
+	drift = DiffTopic("events", current, 1, nil)
+	assert.True(t, drift.HasDrift())
+	assert.False(t, drift.CanIncreasePartitions())
+
+	drift = DiffTopic("events", current, 3, map[string]string{"cleanup.policy": "delete"})
+	assert.False(t, drift.HasDrift())
+}
@@ -10,8 +10,12 @@ import (
 )
 
 const (
-	topicOptRetention   = "retention.ms"
-	topicOptCompression = "compression.type"
+	topicOptRetention         = "retention.ms"
+	topicOptCompression       = "compression.type"
+	topicOptCleanupPolicy     = "cleanup.policy"
+	topicOptMinInsyncReplicas = "min.insync.replicas"
+	topicOptSegmentBytes      = "segment.bytes"
+	topicOptMaxMessageBytes   = "max.message.bytes"
 )
 
 type TopicCompressionType string
@@ -31,32 +35,40 @@ const (
 // https://docs.confluent.io/platform/current/installation/configuration/topic-configs.html
 type TopicOption func(map[string]string)
 
-// Set topic retention period
-func SetTopicRetention(timeFormat string) TopicOption {
+// ParseTopicRetention parses the retention time, either milliseconds, a duration such as 168h, or -1 for unlimited
+// retention, into the retention.ms value.
+func ParseTopicRetention(timeFormat string) (string, error) {
+	if timeFormat == "-1" {
+		return "-1", nil
+	}
 
-	if timeFormat == "" {
-		return func(configMap map[string]string) {
+	duration, err := strconv.ParseInt(timeFormat, 10, 64)
+	if err != nil {
+		timeDuration, err := time.ParseDuration(timeFormat)
+		if err != nil {
+			return "", fmt.Errorf("invalid retention time %q: %w", timeFormat, err)
 		}
+		duration = timeDuration.Milliseconds()
 	}
+	return strconv.FormatInt(duration, 10), nil
+}
 
-	if timeFormat == "-1" {
+// Set topic retention period, an invalid retention time is logged and leaves the retention unchanged
+func SetTopicRetention(timeFormat string) TopicOption {
+	if timeFormat == "" {
 		return func(configMap map[string]string) {
-			configMap[topicOptRetention] = "-1"
 		}
 	}
 
-	duration, err := strconv.ParseInt(timeFormat, 10, 64)
+	retention, err := ParseTopicRetention(timeFormat)
 	if err != nil {
-		timeDuration, err := time.ParseDuration(timeFormat)
-		if err != nil {
-			logger.Log.Error("failed to parse topic retention", zap.Error(err), zap.String("time_format", timeFormat))
-			return nil
+		logger.Log.Error("failed to parse topic retention", zap.Error(err), zap.String("time_format", timeFormat))
+		return func(configMap map[string]string) {
 		}
-		duration = timeDuration.Milliseconds()
 	}
 
 	return func(configMap map[string]string) {
-		configMap[topicOptRetention] = fmt.Sprintf("%d", duration)
+		configMap[topicOptRetention] = retention
 	}
 }
 
@@ -68,3 +80,39 @@ func SetTopicCompressionType(compressionType TopicCompressionType) TopicOption {
 		}
 	}
 }
+
+// Set topic cleanup policy, e.g. delete, compact or compact,delete
+func SetTopicCleanupPolicy(cleanupPolicy string) TopicOption {
+	return func(configMap map[string]string) {
+		if cleanupPolicy != "" {
+			configMap[topicOptCleanupPolicy] = cleanupPolicy
+		}
+	}
+}
+
+// Set the minimum number of in-sync replicas required to acknowledge a write with acks=all
+func SetTopicMinInsyncReplicas(minInsyncReplicas int) TopicOption {
+	return func(configMap map[string]string) {
+		if minInsyncReplicas > 0 {
+			configMap[topicOptMinInsyncReplicas] = strconv.Itoa(minInsyncReplicas)
+		}
+	}
+}
+
+// Set topic log segment size in bytes
+func SetTopicSegmentBytes(segmentBytes int64) TopicOption {
+	return func(configMap map[string]string) {
+		if segmentBytes > 0 {
+			configMap[topicOptSegmentBytes] = strconv.FormatInt(segmentBytes, 10)
+		}
+	}
+}
+
+// Set the largest record batch size allowed by the topic
+func SetTopicMaxMessageBytes(maxMessageBytes int) TopicOption {
+	return func(configMap map[string]string) {
+		if maxMessageBytes > 0 {
+			configMap[topicOptMaxMessageBytes] = strconv.Itoa(maxMessageBytes)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/blockdaemon/chain_sink/pkg/logger"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"go.uber.org/zap"
+)
+
+// transactions groups produced messages into Kafka transactions. A transaction is committed when it holds MaxMessages
+// messages or when MaxLatency has passed since the first message was added, whichever comes first. Every caller
+// blocks until the transaction containing its message is committed, so acks are only sent for committed messages.
+type transactions struct {
+	sync.Mutex
+	producer *kafka.Producer
+	cfg      TransactionConfig
+
+	current *transaction
+	// committing is the transaction being committed, a new transaction is only begun once it is done.
+	committing *transaction
+}
+
+type transaction struct {
+	messages int
+	timer    *time.Timer
+	done     chan struct{}
+	err      error
+}
+
+func newTransactions(producer *kafka.Producer, cfg TransactionConfig) (*transactions, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.CommitTimeout)
+	defer cancel()
+
+	if err := producer.InitTransactions(ctx); err != nil {
+		return nil, err
+	}
+
+	return &transactions{
+		producer: producer,
+		cfg:      cfg,
+	}, nil
+}
+
+func (t *transactions) produce(ctx context.Context, message *kafka.Message) error {
+	txn, err := t.add(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-txn.done:
+		return txn.err
+	}
+}
+
+// add produces the message in the current transaction, starting a new one if required. The returned transaction's
+// done channel is closed once the transaction is committed or aborted.
+func (t *transactions) add(ctx context.Context, message *kafka.Message) (*transaction, error) {
+	t.Lock()
+	// The producer has a single transaction at a time, so a new one waits for the commit in progress.
+	for t.current == nil && t.committing != nil {
+		committing := t.committing
+		t.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-committing.done:
+		}
+		t.Lock()
+	}
+
+	if t.current == nil {
+		if err := t.producer.BeginTransaction(); err != nil {
+			t.Unlock()
+			return nil, fmt.Errorf("error beginning transaction: %w", err)
+		}
+
+		txn := &transaction{done: make(chan struct{})}
+		txn.timer = time.AfterFunc(t.cfg.MaxLatency, func() {
+			t.commit(txn)
+		})
+		t.current = txn
+	}
+
+	txn := t.current
+	if err := t.producer.Produce(message, nil); err != nil {
+		t.Unlock()
+		return nil, err
+	}
+	txn.messages++
+	full := t.cfg.MaxMessages > 0 && txn.messages >= t.cfg.MaxMessages
+	t.Unlock()
+
+	if full {
+		t.commit(txn)
+	}
+
+	return txn, nil
+}
+
+// commit commits the given transaction if it is still the current one, it is a no-op otherwise. The transaction is
+// committed without holding the lock, messages for the next transaction wait in add until it is done.
+func (t *transactions) commit(txn *transaction) {
+	t.Lock()
+	if t.current != txn {
+		t.Unlock()
+		return
+	}
+	t.current = nil
+	t.committing = txn
+	txn.timer.Stop()
+	t.Unlock()
+
+	txn.err = t.commitOrAbort()
+	if txn.err == nil {
+		logger.Log.Debug("Kafka transaction committed", zap.Int("messages", txn.messages))
+	}
+
+	t.Lock()
+	t.committing = nil
+	t.Unlock()
+	close(txn.done)
+}
+
+func (t *transactions) commitOrAbort() error {
+	ctx, cancel := context.WithTimeout(context.Background(), t.cfg.CommitTimeout)
+	defer cancel()
+
+	for {
+		err := t.producer.CommitTransaction(ctx)
+		if err == nil {
+			return nil
+		}
+
+		var kafkaErr kafka.Error
+		if errors.As(err, &kafkaErr) && kafkaErr.IsRetriable() && ctx.Err() == nil {
+			logger.Log.Warn("Retrying kafka transaction commit", zap.Error(err))
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		if errors.As(err, &kafkaErr) && kafkaErr.TxnRequiresAbort() {
+			logger.Log.Warn("Aborting kafka transaction", zap.Error(err))
+			if abortErr := t.producer.AbortTransaction(ctx); abortErr != nil {
+				return fmt.Errorf("error aborting transaction: %w", abortErr)
+			}
+		}
+		return fmt.Errorf("error committing transaction: %w", err)
+	}
+}
+
+// flush commits the transaction in progress.
+func (t *transactions) flush() {
+	t.Lock()
+	txn := t.current
+	t.Unlock()
+
+	if txn != nil {
+		t.commit(txn)
+	}
+}
+
+// close aborts the transaction in progress, callers waiting on it receive an error and the messages are not acked.
+func (t *transactions) close() {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.current == nil {
+		return
+	}
+	txn := t.current
+	t.current = nil
+	txn.timer.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.cfg.CommitTimeout)
+	defer cancel()
+	if err := t.producer.AbortTransaction(ctx); err != nil {
+		logger.Log.Warn("error aborting kafka transaction", zap.Error(err))
+	}
+	txn.err = fmt.Errorf("transaction aborted on close")
+	close(txn.done)
+}
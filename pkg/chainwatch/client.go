@@ -0,0 +1,235 @@
+package chainwatch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultAPIURL is the base url of the Chain Watch REST API.
+const DefaultAPIURL = "https://svc.blockdaemon.com/streaming/v2"
+
+type TargetMode string
+
+const (
+	TargetModeAck   TargetMode = "ack"
+	TargetModeNoAck TargetMode = "noack"
+)
+
+// Target is a Chain Watch target. The read only fields are ignored when a target is created or updated.
+type Target struct {
+	Id                 string         `json:"id,omitempty"`
+	Name               string         `json:"name"`
+	Description        string         `json:"description,omitempty"`
+	Type               string         `json:"type"`
+	MaxBufferCount     int            `json:"max_buffer_count,omitempty"`
+	CurrentBufferCount int            `json:"current_buffer_count,omitempty"`
+	Settings           TargetSettings `json:"settings"`
+	Status             string         `json:"status,omitempty"`
+	StatusSince        *time.Time     `json:"status_since,omitempty"`
+	CreatedAt          *time.Time     `json:"created_at,omitempty"`
+	UpdatedAt          *time.Time     `json:"updated_at,omitempty"`
+}
+
+type TargetSettings struct {
+	Mode TargetMode `json:"mode,omitempty"`
+}
+
+// WebsocketURL returns the url chain sink connects to for the target.
+func (t *Target) WebsocketURL(apiURL string) string {
+	u := strings.TrimSuffix(apiURL, "/")
+	switch {
+	case strings.HasPrefix(u, "https://"):
+		u = "wss://" + strings.TrimPrefix(u, "https://")
+	case strings.HasPrefix(u, "http://"):
+		u = "ws://" + strings.TrimPrefix(u, "http://")
+	}
+	return u + "/targets/" + t.Id + "/websocket"
+}
+
+// APIURLFromWebsocketURL derives the REST API url from a target websocket url, e.g.
+// wss://svc.blockdaemon.com/streaming/v2/targets/<id>/websocket becomes https://svc.blockdaemon.com/streaming/v2.
+func APIURLFromWebsocketURL(websocketURL string) (string, error) {
+	u, err := url.Parse(websocketURL)
+	if err != nil {
+		return "", err
+	}
+
+	index := strings.LastIndex(u.Path, "/targets/")
+	if index < 0 {
+		return "", fmt.Errorf("not a target websocket url: %s", websocketURL)
+	}
+
+	switch u.Scheme {
+	case "wss":
+		u.Scheme = "https"
+	case "ws":
+		u.Scheme = "http"
+	default:
+		return "", fmt.Errorf("not a websocket url: %s", websocketURL)
+	}
+	u.Path = u.Path[:index]
+	u.RawQuery = ""
+	return u.String(), nil
+}
+
+// APIError is returned for responses with a status code other than 2xx.
+type APIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("chain watch API returned status %d: %s", e.StatusCode, e.Body)
+}
+
+// IsNotFound reports whether err is an APIError for a missing resource.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// Client calls the Chain Watch targets REST API.
+type Client struct {
+	apiURL  string
+	apiKey  string
+	headers http.Header
+	http    *http.Client
+}
+
+// ClientOption configures a Client.
+type ClientOption func(*Client)
+
+// WithHeaders adds the headers to every request, e.g. to authenticate with custom headers instead of the API key.
+func WithHeaders(headers http.Header) ClientOption {
+	return func(c *Client) {
+		c.headers = headers
+	}
+}
+
+func NewClient(apiURL string, apiKey string, opts ...ClientOption) *Client {
+	c := &Client{
+		apiURL: strings.TrimSuffix(apiURL, "/"),
+		apiKey: apiKey,
+		http:   &http.Client{Timeout: 30 * time.Second},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+func (c *Client) ListTargets(ctx context.Context) ([]Target, error) {
+	var body json.RawMessage
+	if err := c.do(ctx, http.MethodGet, "/targets", nil, &body); err != nil {
+		return nil, err
+	}
+
+	// The targets are either returned as a list or as the data of a page.
+	var targets []Target
+	if err := json.Unmarshal(body, &targets); err == nil {
+		return targets, nil
+	}
+	var page struct {
+		Data []Target `json:"data"`
+	}
+	if err := json.Unmarshal(body, &page); err != nil {
+		return nil, fmt.Errorf("error decoding targets: %w", err)
+	}
+	return page.Data, nil
+}
+
+func (c *Client) GetTarget(ctx context.Context, id string) (*Target, error) {
+	target := new(Target)
+	if err := c.do(ctx, http.MethodGet, "/targets/"+url.PathEscape(id), nil, target); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+func (c *Client) CreateTarget(ctx context.Context, target Target) (*Target, error) {
+	created := new(Target)
+	if err := c.do(ctx, http.MethodPost, "/targets", writableTarget(target), created); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// UpdateTarget replaces the writable fields of the target with the given id.
+func (c *Client) UpdateTarget(ctx context.Context, target Target) (*Target, error) {
+	updated := new(Target)
+	if err := c.do(ctx, http.MethodPut, "/targets/"+url.PathEscape(target.Id), writableTarget(target), updated); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+func (c *Client) DeleteTarget(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/targets/"+url.PathEscape(id), nil, nil)
+}
+
+// writableTarget clears the read only fields of the target.
+func writableTarget(target Target) Target {
+	return Target{
+		Name:           target.Name,
+		Description:    target.Description,
+		Type:           target.Type,
+		MaxBufferCount: target.MaxBufferCount,
+		Settings:       target.Settings,
+	}
+}
+
+// do sends the request with body encoded as JSON, if not nil, and decodes the response into result, if not nil.
+func (c *Client) do(ctx context.Context, method string, path string, body any, result any) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.apiURL+path, reader)
+	if err != nil {
+		return err
+	}
+	for key, values := range c.headers {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("x-api-key", c.apiKey)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		responseBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &APIError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(responseBody))}
+	}
+
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("error decoding response: %w", err)
+	}
+	return nil
+}
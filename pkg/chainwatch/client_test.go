@@ -0,0 +1,57 @@
+package chainwatch
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIURLFromWebsocketURL(t *testing.T) {
+	apiURL, err := APIURLFromWebsocketURL("wss://svc.blockdaemon.com/streaming/v2/targets/e89d7256-174f-429d-9a79-13ef57fb9e4f/websocket")
+	require.NoError(t, err)
+	assert.Equal(t, DefaultAPIURL, apiURL)
+
+	apiURL, err = APIURLFromWebsocketURL("ws://localhost:8765/targets/e89d7256-174f-429d-9a79-13ef57fb9e4f/websocket")
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost:8765", apiURL)
+
+	_, err = APIURLFromWebsocketURL("https://svc.blockdaemon.com/streaming/v2/targets/id/websocket")
+	assert.ErrorContains(t, err, "not a websocket url")
+	_, err = APIURLFromWebsocketURL("wss://svc.blockdaemon.com/streaming/v2")
+	assert.ErrorContains(t, err, "not a target websocket url")
+
+	target := Target{Id: "e89d7256-174f-429d-9a79-13ef57fb9e4f"}
+	assert.Equal(t, "wss://svc.blockdaemon.com/streaming/v2/targets/e89d7256-174f-429d-9a79-13ef57fb9e4f/websocket", target.WebsocketURL(DefaultAPIURL+"/"))
+}
+
+func TestClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-api-key") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"message":"unauthorized"}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/targets":
+			_, _ = w.Write([]byte(`{"data":[{"id":"a","name":"first","type":"websocket","settings":{"mode":"ack"}}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, "key")
+	targets, err := client.ListTargets(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []Target{{Id: "a", Name: "first", Type: "websocket", Settings: TargetSettings{Mode: TargetModeAck}}}, targets)
+
+	_, err = client.GetTarget(context.Background(), "missing")
+	assert.True(t, IsNotFound(err))
+
+	_, err = NewClient(server.URL, "").ListTargets(context.Background())
+	assert.EqualError(t, err, `chain watch API returned status 401: {"message":"unauthorized"}`)
+}
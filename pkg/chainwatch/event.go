@@ -0,0 +1,74 @@
+// Package chainwatch models the Chain Watch API. Event is a typed copy of the event fields chain sink relies on for
+// code that is not performance sensitive, View reads them from a parsed message without copying for hot paths. Client
+// calls the targets REST API.
+package chainwatch
+
+import (
+	"fmt"
+
+	"github.com/valyala/fastjson"
+)
+
+// FieldId is the id of an event. A websocket target in ack mode expects the id back as the acknowledgement
+// {"id": <id>}, so it is the one field every event carries. The other fields depend on the rule that produced the
+// event, see https://docs.blockdaemon.com/docs/overview-events, processors read them by configurable paths.
+const FieldId = "id"
+
+// Event holds the fields of an event that chain sink relies on.
+type Event struct {
+	Id string
+}
+
+var parserPool = fastjson.ParserPool{}
+
+// Unmarshal copies the fields of the message into an Event.
+func Unmarshal(message []byte) (*Event, error) {
+	parser := parserPool.Get()
+	defer parserPool.Put(parser)
+
+	view, err := Parse(parser, message)
+	if err != nil {
+		return nil, err
+	}
+	return &Event{Id: string(view.Id())}, nil
+}
+
+// View reads the fields of a parsed message. The returned byte slices point into the parser's memory, they are only
+// valid until the parser is reused and must not be modified.
+type View struct {
+	value *fastjson.Value
+}
+
+// Parse parses the message with the parser and returns a view of it.
+func Parse(parser *fastjson.Parser, message []byte) (View, error) {
+	value, err := parser.ParseBytes(message)
+	if err != nil {
+		return View{}, err
+	}
+	if value.Type() != fastjson.TypeObject {
+		return View{}, fmt.Errorf("event must be a JSON object, got %s", value.Type())
+	}
+	return View{value: value}, nil
+}
+
+// NewView returns a view of an already parsed message.
+func NewView(value *fastjson.Value) View {
+	return View{value: value}
+}
+
+// Value returns the whole parsed message.
+func (v View) Value() *fastjson.Value {
+	return v.value
+}
+
+// Id returns the id as a string, numeric ids are returned in their JSON representation.
+func (v View) Id() []byte {
+	id := v.value.Get(FieldId)
+	if id == nil {
+		return nil
+	}
+	if id.Type() == fastjson.TypeString {
+		return id.GetStringBytes()
+	}
+	return id.MarshalTo(nil)
+}
@@ -0,0 +1,33 @@
+package chainwatch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fastjson"
+)
+
+func TestUnmarshal(t *testing.T) {
+	event, err := Unmarshal([]byte(`{"id": "0f0e4b1c-7a53-4d8e-b1c2-3e4f5a6b7c8d", "block": {"number": 10}}`))
+	require.NoError(t, err)
+	assert.Equal(t, &Event{Id: "0f0e4b1c-7a53-4d8e-b1c2-3e4f5a6b7c8d"}, event)
+
+	_, err = Unmarshal([]byte(`[1]`))
+	assert.EqualError(t, err, "event must be a JSON object, got array")
+	_, err = Unmarshal([]byte(`{`))
+	assert.Error(t, err)
+}
+
+func TestView(t *testing.T) {
+	var parser fastjson.Parser
+	view, err := Parse(&parser, []byte(`{"id": 42, "data": {"a": 1}}`))
+	require.NoError(t, err)
+
+	assert.Equal(t, "42", string(view.Id()))
+	assert.Equal(t, 1, view.Value().GetInt("data", "a"))
+
+	view, err = Parse(&parser, []byte(`{"data": {}}`))
+	require.NoError(t, err)
+	assert.Nil(t, view.Id())
+}
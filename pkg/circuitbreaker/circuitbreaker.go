@@ -0,0 +1,345 @@
+// Package circuitbreaker stops handing messages to a failing adapter until it recovers.
+package circuitbreaker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/blockdaemon/chain_sink/pkg/logger"
+	"github.com/blockdaemon/chain_sink/pkg/metrics"
+	"github.com/blockdaemon/chain_sink/pkg/stream"
+	"go.uber.org/zap"
+)
+
+type Config struct {
+	// ConsecutiveFailures is the number of failed deliveries in a row that opens the breaker.
+	ConsecutiveFailures int `mapstructure:"consecutive_failures" default:"5" validate:"gte=1"`
+	// ErrorRate is the fraction of failed deliveries within Window that opens the breaker, disabled if 0.
+	ErrorRate float64 `mapstructure:"error_rate" validate:"gte=0,lte=1"`
+	// MinDeliveries is the number of deliveries within Window before ErrorRate is applied.
+	MinDeliveries int           `mapstructure:"min_deliveries" default:"20" validate:"gte=1"`
+	Window        time.Duration `mapstructure:"window" default:"1m" validate:"gt=0"`
+	// OpenTimeout is the time the breaker stays open before trial messages are let through.
+	OpenTimeout time.Duration `mapstructure:"open_timeout" default:"30s" validate:"gt=0"`
+	// HalfOpenProbes is the number of trial messages handed to the adapter at a time while the breaker is half open.
+	HalfOpenProbes int `mapstructure:"half_open_probes" default:"1" validate:"gte=1"`
+	// RetryDelay is the delay before the first retry of a failed delivery, it doubles with every retry up to
+	// MaxRetryDelay.
+	RetryDelay    time.Duration `mapstructure:"retry_delay" default:"100ms" validate:"gt=0"`
+	MaxRetryDelay time.Duration `mapstructure:"max_retry_delay" default:"5s" validate:"gtefield=RetryDelay"`
+	// MaxRetries is the number of times a failed delivery is retried before the error is returned, unlimited if 0.
+	MaxRetries int `mapstructure:"max_retries" default:"10" validate:"gte=0"`
+}
+
+// retryDelay returns the delay before the retry following the given number of retries.
+func (c *Config) retryDelay(retries int) time.Duration {
+	delay := c.RetryDelay
+	for range retries {
+		if delay >= c.MaxRetryDelay {
+			break
+		}
+		delay *= 2
+	}
+	return min(delay, c.MaxRetryDelay)
+}
+
+type State int
+
+const (
+	StateClosed State = iota
+	StateOpen
+	StateHalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half_open"
+	}
+	return "unknown"
+}
+
+var _ stream.AsyncAdapter = (*Breaker)(nil)
+var _ stream.Lifecycle = (*Breaker)(nil)
+
+// Breaker is an adapter that retries failed deliveries instead of failing the stream. Once the adapter keeps failing
+// the breaker opens and messages wait until OpenTimeout passed, so the stream's workers stop taking messages and
+// Chain Watch buffers them. Then the breaker is half open and lets HalfOpenProbes messages through, it closes if a
+// trial message is delivered and opens again otherwise. Messages are failed once their context is cancelled or
+// their delivery failed MaxRetries times after the first attempt, the stream's redelivery then applies.
+//
+// If the next adapter implements stream.Lifecycle it is started, flushed and closed with the Breaker.
+type Breaker struct {
+	name string
+	cfg  Config
+	next stream.Adapter
+	log  *zap.Logger
+
+	mu    sync.Mutex
+	state State
+	// changed is closed and replaced when the state changes, it wakes up the messages waiting for the breaker.
+	changed  chan struct{}
+	openedAt time.Time
+	probes   int
+	// consecutiveFailures, deliveries and failures are counted while the breaker is closed, deliveries and failures
+	// are reset every Window.
+	consecutiveFailures int
+	windowStart         time.Time
+	deliveries          int
+	failures            int
+}
+
+// Wrap creates a breaker for the next adapter, name identifies the adapter in logs and metrics.
+func Wrap(name string, cfg Config, next stream.Adapter) *Breaker {
+	return &Breaker{
+		name:        name,
+		cfg:         cfg,
+		next:        next,
+		log:         logger.Log.With(zap.String("adapter", name)),
+		changed:     make(chan struct{}),
+		windowStart: time.Now(),
+	}
+}
+
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// acquire waits until the breaker lets a message through, probe reports whether it is a trial message.
+func (b *Breaker) acquire(ctx context.Context) (probe bool, err error) {
+	for {
+		b.mu.Lock()
+		if b.state == StateOpen && time.Since(b.openedAt) >= b.cfg.OpenTimeout {
+			b.setState(ctx, StateHalfOpen, nil)
+		}
+
+		switch {
+		case b.state == StateClosed:
+			b.mu.Unlock()
+			return false, nil
+		case b.state == StateHalfOpen && b.probes < b.cfg.HalfOpenProbes:
+			b.probes++
+			b.mu.Unlock()
+			return true, nil
+		}
+
+		// An open breaker is half open after OpenTimeout, a half open breaker waits for a trial message to complete.
+		changed := b.changed
+		var timer *time.Timer
+		var halfOpen <-chan time.Time
+		if b.state == StateOpen {
+			timer = time.NewTimer(b.cfg.OpenTimeout - time.Since(b.openedAt))
+			halfOpen = timer.C
+		}
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-changed:
+		case <-halfOpen:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// release records the result of a delivery and opens or closes the breaker.
+func (b *Breaker) release(ctx context.Context, probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probes--
+	}
+
+	if b.state == StateHalfOpen {
+		// Deliveries that were started before the breaker opened do not decide whether it closes.
+		if !probe {
+			return
+		}
+		if err == nil {
+			b.setState(ctx, StateClosed, nil)
+		} else {
+			b.setState(ctx, StateOpen, err)
+		}
+		return
+	}
+
+	if b.state != StateClosed {
+		return
+	}
+
+	if time.Since(b.windowStart) >= b.cfg.Window {
+		b.windowStart = time.Now()
+		b.deliveries, b.failures = 0, 0
+	}
+	b.deliveries++
+	if err == nil {
+		b.consecutiveFailures = 0
+		return
+	}
+	b.failures++
+	b.consecutiveFailures++
+
+	errorRate := float64(b.failures) / float64(b.deliveries)
+	if b.consecutiveFailures >= b.cfg.ConsecutiveFailures ||
+		(b.cfg.ErrorRate > 0 && b.deliveries >= b.cfg.MinDeliveries && errorRate >= b.cfg.ErrorRate) {
+		b.setState(ctx, StateOpen, err)
+	}
+}
+
+// setState changes the state and wakes up the waiting messages, the caller must hold the lock. err is the delivery
+// error that opened the breaker.
+func (b *Breaker) setState(ctx context.Context, state State, err error) {
+	previous := b.state
+	b.state = state
+	close(b.changed)
+	b.changed = make(chan struct{})
+
+	switch state {
+	case StateOpen:
+		b.openedAt = time.Now()
+		b.log.Warn("circuit breaker opened", zap.Stringer("previous_state", previous), zap.Duration("open_timeout", b.cfg.OpenTimeout),
+			zap.Int("consecutive_failures", b.consecutiveFailures), zap.Int("deliveries", b.deliveries), zap.Int("failures", b.failures), zap.Error(err))
+	case StateHalfOpen:
+		b.log.Info("circuit breaker half open, sending trial messages", zap.Int("half_open_probes", b.cfg.HalfOpenProbes))
+	case StateClosed:
+		b.consecutiveFailures, b.deliveries, b.failures = 0, 0, 0
+		b.windowStart = time.Now()
+		b.log.Info("circuit breaker closed")
+	}
+	metrics.G.RecordCircuitBreakerState(ctx, b.name, int64(state))
+}
+
+// backoff waits before the retry following the given number of retries of a delivery that failed with err. It
+// returns the error the message fails with if it is not retried, because the retries are used up or ctx is done.
+func (b *Breaker) backoff(ctx context.Context, retries int, err error) error {
+	if ctx.Err() != nil {
+		return err
+	}
+	if b.cfg.MaxRetries > 0 && retries >= b.cfg.MaxRetries {
+		b.log.Warn("message failed after retries", zap.Int("retries", retries), zap.Error(err))
+		return fmt.Errorf("delivery failed after %d retries: %w", retries, err)
+	}
+
+	delay := b.cfg.retryDelay(retries)
+	b.log.Debug("retrying message after adapter error", zap.Duration("delay", delay), zap.Error(err))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// HandleMessage delivers the message, retrying until it succeeds, the retries are used up or ctx is cancelled.
+func (b *Breaker) HandleMessage(ctx context.Context, message []byte) error {
+	for retries := 0; ; retries++ {
+		probe, err := b.acquire(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = b.next.HandleMessage(ctx, message)
+		b.release(ctx, probe, err)
+		if err == nil {
+			return nil
+		}
+		if err := b.backoff(ctx, retries, err); err != nil {
+			return err
+		}
+	}
+}
+
+// HandleMessageAsync hands the message to the next adapter once the breaker lets it through. Failed deliveries are
+// retried in the background and done is called once the message was delivered, the retries are used up or ctx is
+// cancelled.
+func (b *Breaker) HandleMessageAsync(ctx context.Context, message []byte, done func(error)) error {
+	asyncAdapter, ok := b.next.(stream.AsyncAdapter)
+	if !ok {
+		err := b.HandleMessage(ctx, message)
+		if err == nil {
+			done(nil)
+		}
+		return err
+	}
+	return b.handleAsync(ctx, asyncAdapter, message, 0, done)
+}
+
+// handleAsync hands the message to the adapter, retries is the number of times the delivery was retried before.
+func (b *Breaker) handleAsync(ctx context.Context, adapter stream.AsyncAdapter, message []byte, retries int, done func(error)) error {
+	for ; ; retries++ {
+		probe, err := b.acquire(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = adapter.HandleMessageAsync(ctx, message, func(err error) {
+			b.completed(ctx, adapter, message, probe, retries, err, done)
+		})
+		if err == nil {
+			return nil
+		}
+		b.release(ctx, probe, err)
+		if err := b.backoff(ctx, retries, err); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *Breaker) completed(ctx context.Context, adapter stream.AsyncAdapter, message []byte, probe bool, retries int, err error, done func(error)) {
+	b.release(ctx, probe, err)
+	if err == nil {
+		done(nil)
+		return
+	}
+
+	// The retry waits for the backoff and the breaker, which must not block the adapter's callback.
+	go func() {
+		if err := b.backoff(ctx, retries, err); err != nil {
+			done(err)
+			return
+		}
+		if err := b.handleAsync(ctx, adapter, message, retries+1, done); err != nil {
+			done(err)
+		}
+	}()
+}
+
+// Start records the breaker state and starts the next adapter.
+func (b *Breaker) Start(ctx context.Context) error {
+	metrics.G.RecordCircuitBreakerState(ctx, b.name, int64(b.State()))
+	if lifecycle, ok := b.next.(stream.Lifecycle); ok {
+		return lifecycle.Start(ctx)
+	}
+	return nil
+}
+
+func (b *Breaker) Flush(ctx context.Context) error {
+	if lifecycle, ok := b.next.(stream.Lifecycle); ok {
+		return lifecycle.Flush(ctx)
+	}
+	return nil
+}
+
+func (b *Breaker) Close(ctx context.Context) error {
+	if lifecycle, ok := b.next.(stream.Lifecycle); ok {
+		return lifecycle.Close(ctx)
+	}
+	return nil
+}
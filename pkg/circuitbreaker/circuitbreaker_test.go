@@ -0,0 +1,137 @@
+package circuitbreaker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errDelivery = errors.New("delivery failed")
+
+// scriptedAdapter fails or succeeds the deliveries in the order of results, and succeeds once they are used up.
+type scriptedAdapter struct {
+	sync.Mutex
+	results    []error
+	deliveries int
+}
+
+func (a *scriptedAdapter) next() error {
+	a.Lock()
+	defer a.Unlock()
+	a.deliveries++
+	if len(a.results) == 0 {
+		return nil
+	}
+	result := a.results[0]
+	a.results = a.results[1:]
+	return result
+}
+
+func (a *scriptedAdapter) HandleMessage(context.Context, []byte) error {
+	return a.next()
+}
+
+type asyncScriptedAdapter struct {
+	scriptedAdapter
+}
+
+func (a *asyncScriptedAdapter) HandleMessageAsync(_ context.Context, _ []byte, done func(error)) error {
+	err := a.next()
+	go done(err)
+	return nil
+}
+
+func TestBreaker_consecutiveFailures(t *testing.T) {
+	adapter := &scriptedAdapter{results: []error{errDelivery, errDelivery, errDelivery}}
+	breaker := Wrap("test", Config{ConsecutiveFailures: 2, MinDeliveries: 1, Window: time.Minute, OpenTimeout: 20 * time.Millisecond, HalfOpenProbes: 1}, adapter)
+
+	start := time.Now()
+	require.NoError(t, breaker.HandleMessage(context.Background(), []byte("a")))
+
+	// The breaker opened after the second failure, and again after the failed trial message.
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+	assert.Equal(t, 4, adapter.deliveries)
+	assert.Equal(t, StateClosed, breaker.State())
+}
+
+func TestBreaker_openBlocks(t *testing.T) {
+	adapter := &scriptedAdapter{results: []error{errDelivery}}
+	breaker := Wrap("test", Config{ConsecutiveFailures: 1, MinDeliveries: 1, Window: time.Minute, OpenTimeout: time.Hour, HalfOpenProbes: 1}, adapter)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, breaker.HandleMessage(ctx, []byte("a")), context.DeadlineExceeded)
+	assert.Equal(t, StateOpen, breaker.State())
+	assert.Equal(t, 1, adapter.deliveries)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, breaker.HandleMessageAsync(ctx, []byte("b"), func(error) {
+		t.Fatal("done must not be called")
+	}), context.DeadlineExceeded)
+	assert.Equal(t, 1, adapter.deliveries, "messages wait while the breaker is open")
+}
+
+func TestBreaker_errorRate(t *testing.T) {
+	adapter := &scriptedAdapter{results: []error{nil, errDelivery, errDelivery, errDelivery}}
+	breaker := Wrap("test", Config{ConsecutiveFailures: 10, ErrorRate: 0.7, MinDeliveries: 4, Window: time.Minute, OpenTimeout: time.Hour, HalfOpenProbes: 1}, adapter)
+
+	require.NoError(t, breaker.HandleMessage(context.Background(), []byte("a")))
+	assert.Equal(t, StateClosed, breaker.State())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, breaker.HandleMessage(ctx, []byte("b")), context.DeadlineExceeded)
+	assert.Equal(t, StateOpen, breaker.State(), "3 of 4 deliveries failed")
+	assert.Equal(t, 4, adapter.deliveries)
+}
+
+func TestBreaker_async(t *testing.T) {
+	adapter := &asyncScriptedAdapter{scriptedAdapter{results: []error{errDelivery}}}
+	breaker := Wrap("test", Config{ConsecutiveFailures: 1, MinDeliveries: 1, Window: time.Minute, OpenTimeout: 10 * time.Millisecond, HalfOpenProbes: 1}, adapter)
+
+	result := make(chan error, 1)
+	require.NoError(t, breaker.HandleMessageAsync(context.Background(), []byte("a"), func(err error) { result <- err }))
+
+	select {
+	case err := <-result:
+		assert.NoError(t, err, "the failed delivery is retried")
+	case <-time.After(time.Second):
+		t.Fatal("message was not completed")
+	}
+	assert.Equal(t, 2, adapter.deliveries)
+	assert.Equal(t, StateClosed, breaker.State())
+}
+
+func TestBreaker_maxRetries(t *testing.T) {
+	cfg := Config{ConsecutiveFailures: 10, MinDeliveries: 1, Window: time.Minute, OpenTimeout: time.Hour, HalfOpenProbes: 1,
+		RetryDelay: 5 * time.Millisecond, MaxRetryDelay: 8 * time.Millisecond, MaxRetries: 2}
+
+	adapter := &scriptedAdapter{results: []error{errDelivery, errDelivery, errDelivery, errDelivery}}
+	breaker := Wrap("test", cfg, adapter)
+	start := time.Now()
+	err := breaker.HandleMessage(context.Background(), []byte("a"))
+	assert.ErrorIs(t, err, errDelivery)
+	assert.EqualError(t, err, "delivery failed after 2 retries: delivery failed")
+	assert.GreaterOrEqual(t, time.Since(start), 13*time.Millisecond, "the retries back off")
+	assert.Equal(t, 3, adapter.deliveries)
+	assert.Equal(t, StateClosed, breaker.State())
+
+	asyncAdapter := &asyncScriptedAdapter{scriptedAdapter{results: []error{errDelivery, errDelivery, errDelivery, errDelivery}}}
+	breaker = Wrap("test", cfg, asyncAdapter)
+	result := make(chan error, 1)
+	require.NoError(t, breaker.HandleMessageAsync(context.Background(), []byte("b"), func(err error) { result <- err }))
+
+	select {
+	case err := <-result:
+		assert.ErrorIs(t, err, errDelivery, "the message is failed back to the stream")
+	case <-time.After(time.Second):
+		t.Fatal("message was not completed")
+	}
+	assert.Equal(t, 3, asyncAdapter.deliveries)
+}
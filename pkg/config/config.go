@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"reflect"
 	"strings"
 
 	"github.com/blockdaemon/chain_sink/pkg/logger"
@@ -17,21 +18,27 @@ const (
 	PREFIX      = "BD_"
 )
 
+// LoadConfig loads the config files listed in BD_CONFIG_FILES, see LoadConfigFiles.
 func LoadConfig[T any]() (T, error) {
-
-	var cfg T
-
 	files := os.Getenv(ConfigFiles)
 	if files == "" {
+		var cfg T
 		return cfg, fmt.Errorf("no config files specified")
 	}
+	return LoadConfigFiles[T](strings.Split(files, " ")...)
+}
+
+// LoadConfigFiles loads the config files, later files are merged into earlier ones. It applies the default values and
+// validates the config. If the config type has a `Validate() error` method on its pointer it is called after the
+// struct validation.
+func LoadConfigFiles[T any](files ...string) (T, error) {
 
-	var cfgFile string
-	fileSplits := strings.Split(files, " ")
-	if len(fileSplits) >= 1 {
-		cfgFile = fileSplits[0]
-		fileSplits = fileSplits[1:]
+	var cfg T
+
+	if len(files) == 0 {
+		return cfg, fmt.Errorf("no config files specified")
 	}
+	cfgFile, fileSplits := files[0], files[1:]
 
 	v := viper.GetViper()
 	v.SetEnvPrefix(PREFIX)
@@ -53,13 +60,44 @@ func LoadConfig[T any]() (T, error) {
 		return cfg, err
 	}
 
-	defaults.SetDefaults(&cfg)
+	setDefaults(reflect.ValueOf(&cfg))
 
 	if err := validator.New().Struct(cfg); err != nil {
 		return cfg, fmt.Errorf("config validation failed: %w", err)
 	}
 
-	logger.Log.Debug("config loaded", zap.Any("config", cfg))
+	if v, ok := any(&cfg).(interface{ Validate() error }); ok {
+		if err := v.Validate(); err != nil {
+			return cfg, fmt.Errorf("config validation failed: %w", err)
+		}
+	}
+
+	logger.Log.Debug("config loaded", zap.Any("config", Map(cfg)))
 
 	return cfg, nil
 }
+
+// setDefaults applies the default tags to v. Unlike go-defaults it also applies the defaults to structs behind
+// pointers, e.g. optional adapter configuration.
+func setDefaults(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return
+		}
+		if v.Elem().Kind() == reflect.Struct {
+			defaults.SetDefaults(v.Interface())
+		}
+		setDefaults(v.Elem())
+	case reflect.Struct:
+		for i := range v.NumField() {
+			if v.Type().Field(i).IsExported() {
+				setDefaults(v.Field(i))
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := range v.Len() {
+			setDefaults(v.Index(i))
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blockdaemon/chain_sink/internal/logtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testNested struct {
+	Size    int           `mapstructure:"size" default:"10"`
+	Timeout time.Duration `mapstructure:"timeout" default:"5s"`
+}
+
+type testConfig struct {
+	Name     string       `mapstructure:"name" default:"chain_sink"`
+	Optional *testNested  `mapstructure:"optional"`
+	Missing  *testNested  `mapstructure:"missing"`
+	List     []testNested `mapstructure:"list"`
+	Invalid  bool         `mapstructure:"invalid"`
+}
+
+func (c *testConfig) Validate() error {
+	if c.Invalid {
+		return errors.New("invalid config")
+	}
+	return nil
+}
+
+func writeConfig(t *testing.T, content string) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	t.Setenv(ConfigFiles, path)
+}
+
+func TestLoadConfig_defaults(t *testing.T) {
+	writeConfig(t, "optional:\n  size: 3\nlist:\n  - timeout: 1s\n")
+
+	cfg, err := LoadConfig[testConfig]()
+	require.NoError(t, err)
+	assert.Equal(t, "chain_sink", cfg.Name)
+	assert.Equal(t, &testNested{Size: 3, Timeout: 5 * time.Second}, cfg.Optional)
+	assert.Nil(t, cfg.Missing)
+	assert.Equal(t, []testNested{{Size: 10, Timeout: time.Second}}, cfg.List)
+}
+
+func TestLoadConfig_validate(t *testing.T) {
+	writeConfig(t, "invalid: true\n")
+
+	_, err := LoadConfig[testConfig]()
+	assert.ErrorContains(t, err, "invalid config")
+}
+
+func TestLoadConfigFiles(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.yaml")
+	override := filepath.Join(dir, "override.yaml")
+	require.NoError(t, os.WriteFile(base, []byte("name: base\noptional:\n  size: 3\n"), 0o600))
+	require.NoError(t, os.WriteFile(override, []byte("optional:\n  size: 4\n"), 0o600))
+
+	cfg, err := LoadConfigFiles[testConfig](base, override)
+	require.NoError(t, err)
+	assert.Equal(t, "base", cfg.Name)
+	assert.Equal(t, &testNested{Size: 4, Timeout: 5 * time.Second}, cfg.Optional)
+
+	_, err = LoadConfigFiles[testConfig]()
+	assert.EqualError(t, err, "no config files specified")
+}
+
+type testSecrets struct {
+	Nested   testNested `mapstructure:",squash"`
+	ApiKey   string     `mapstructure:"api_key" secret:"true"`
+	Password string     `mapstructure:"password" secret:"true"`
+	Hosts    []string
+	Labels   map[string]int `mapstructure:"labels"`
+}
+
+func TestMap(t *testing.T) {
+	cfg := testSecrets{
+		Nested: testNested{Size: 1, Timeout: time.Minute},
+		ApiKey: "key",
+		Hosts:  []string{"a", "b"},
+	}
+
+	assert.Equal(t, map[string]any{
+		"size":     1,
+		"timeout":  "1m0s",
+		"api_key":  Redacted,
+		"password": "",
+		"Hosts":    []any{"a", "b"},
+	}, Map(&cfg))
+}
+
+func TestLoadConfig_logsRedactedConfig(t *testing.T) {
+	logs := logtest.Capture(t)
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("api_key: config-api-key\npassword: config-password\n"), 0o600))
+
+	cfg, err := LoadConfigFiles[testSecrets](path)
+	require.NoError(t, err)
+	assert.Equal(t, "config-api-key", cfg.ApiKey, "only the logged config is redacted")
+
+	assert.Contains(t, logs.String(), "config loaded")
+	assert.NotContains(t, logs.String(), "config-api-key")
+	assert.NotContains(t, logs.String(), "config-password")
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Redacted replaces the value of secret fields.
+const Redacted = "[redacted]"
+
+// Redacter is implemented by config values that can not be redacted with the secret tag, e.g. because it depends on
+// another field whether a value is secret.
+type Redacter interface {
+	// Redacted returns a copy with the secret values replaced by Redacted.
+	Redacted() any
+}
+
+// Map converts the config into maps keyed by the mapstructure names, in the shape of the config file. Fields tagged
+// with `secret:"true"` that are set are replaced by Redacted, as are the secrets of values implementing Redacter. Nil
+// pointers, slices and maps are left out. The result is safe to log or print.
+func Map(cfg any) any {
+	value, _ := mapValue(reflect.ValueOf(cfg))
+	return value
+}
+
+// mapValue returns the value of v for Map, ok is false if v is left out.
+func mapValue(v reflect.Value) (value any, ok bool) {
+	if !v.IsValid() {
+		return nil, false
+	}
+	if (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) && v.IsNil() {
+		return nil, false
+	}
+	if redacter, isRedacter := v.Interface().(Redacter); isRedacter {
+		return mapRedacted(reflect.ValueOf(redacter.Redacted()))
+	}
+	return mapRedacted(v)
+}
+
+// mapRedacted returns the value of v for Map, v itself is already redacted.
+func mapRedacted(v reflect.Value) (value any, ok bool) {
+	if d, isDuration := v.Interface().(time.Duration); isDuration {
+		return d.String(), true
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return mapValue(v.Elem())
+	case reflect.Struct:
+		if t, isTime := v.Interface().(time.Time); isTime {
+			return t, true
+		}
+		m := make(map[string]any)
+		mapStruct(v, m)
+		return m, true
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil, false
+		}
+		list := make([]any, 0, v.Len())
+		for i := range v.Len() {
+			item, _ := mapValue(v.Index(i))
+			list = append(list, item)
+		}
+		return list, true
+	case reflect.Map:
+		if v.IsNil() {
+			return nil, false
+		}
+		m := make(map[string]any, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			if item, ok := mapValue(iter.Value()); ok {
+				m[fmt.Sprint(iter.Key().Interface())] = item
+			}
+		}
+		return m, true
+	}
+	return v.Interface(), true
+}
+
+// mapStruct adds the fields of the struct to m, squashed structs are added to m itself.
+func mapStruct(v reflect.Value, m map[string]any) {
+	for i := range v.NumField() {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, options, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+		if name == "-" {
+			continue
+		}
+		if options == "squash" {
+			if squashed := reflect.Indirect(v.Field(i)); squashed.Kind() == reflect.Struct {
+				mapStruct(squashed, m)
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		if field.Tag.Get("secret") == "true" && !v.Field(i).IsZero() {
+			m[name] = Redacted
+			continue
+		}
+		if value, ok := mapValue(v.Field(i)); ok {
+			m[name] = value
+		}
+	}
+}
@@ -3,19 +3,41 @@ package metrics
 import (
 	"context"
 
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/metric"
 )
 
+// Meters records the application metrics. Stream metrics are labelled with the Chain Watch target id, pipeline
+// metrics with the pipeline name.
 type Meters interface {
-	RecordMessagesReceived(ctx context.Context)
-	RecordMessagesAcked(ctx context.Context)
-	RecordMessagesForwardedToAdapter(ctx context.Context)
+	RecordMessagesReceived(ctx context.Context, target string)
+	RecordMessagesAcked(ctx context.Context, target string)
+	RecordMessagesForwardedToAdapter(ctx context.Context, target string)
+	RecordMessagesRequeued(ctx context.Context, target string)
+	RecordTargetBuffer(ctx context.Context, target string, current int64, max int64)
+	RecordMessagesDropped(ctx context.Context, pipeline string)
+	RecordMessagesDeduplicated(ctx context.Context, pipeline string)
+	RecordMessagesQuarantined(ctx context.Context, pipeline string)
+	RecordCircuitBreakerState(ctx context.Context, adapter string, state int64)
 }
 
+const (
+	attributeTargetId = "target_id"
+	attributePipeline = "pipeline"
+	attributeAdapter  = "adapter"
+)
+
 type OtelMeters struct {
 	messagesReceived           metric.Int64Counter
 	messagesAcked              metric.Int64Counter
 	messagesForwardedToAdapter metric.Int64Counter
+	messagesRequeued           metric.Int64Counter
+	targetBufferCount          metric.Int64Gauge
+	targetBufferMax            metric.Int64Gauge
+	messagesDropped            metric.Int64Counter
+	messagesDeduplicated       metric.Int64Counter
+	messagesQuarantined        metric.Int64Counter
+	circuitBreakerState        metric.Int64Gauge
 }
 
 func New(provider metric.MeterProvider) (*OtelMeters, error) {
@@ -36,23 +58,101 @@ func New(provider metric.MeterProvider) (*OtelMeters, error) {
 		return nil, err
 	}
 
+	messagesRequeued, err := meter.Int64Counter("messages_requeued")
+	if err != nil {
+		return nil, err
+	}
+
+	targetBufferCount, err := meter.Int64Gauge("target_buffer_count",
+		metric.WithDescription("Number of messages buffered by Chain Watch for the target"))
+	if err != nil {
+		return nil, err
+	}
+
+	targetBufferMax, err := meter.Int64Gauge("target_buffer_max",
+		metric.WithDescription("Maximum number of messages Chain Watch buffers for the target"))
+	if err != nil {
+		return nil, err
+	}
+
+	messagesDropped, err := meter.Int64Counter("messages_dropped")
+	if err != nil {
+		return nil, err
+	}
+
+	messagesDeduplicated, err := meter.Int64Counter("messages_deduplicated")
+	if err != nil {
+		return nil, err
+	}
+
+	messagesQuarantined, err := meter.Int64Counter("messages_quarantined")
+	if err != nil {
+		return nil, err
+	}
+
+	circuitBreakerState, err := meter.Int64Gauge("circuit_breaker_state",
+		metric.WithDescription("State of the adapter circuit breaker, 0 closed, 1 open, 2 half open"))
+	if err != nil {
+		return nil, err
+	}
+
 	return &OtelMeters{
 		messagesReceived:           messagesReceived,
 		messagesAcked:              messagesAcked,
 		messagesForwardedToAdapter: messagesForwardedToAdapter,
+		messagesRequeued:           messagesRequeued,
+		targetBufferCount:          targetBufferCount,
+		targetBufferMax:            targetBufferMax,
+		messagesDropped:            messagesDropped,
+		messagesDeduplicated:       messagesDeduplicated,
+		messagesQuarantined:        messagesQuarantined,
+		circuitBreakerState:        circuitBreakerState,
 	}, nil
 }
 
 var _ Meters = (*OtelMeters)(nil)
 
-func (m *OtelMeters) RecordMessagesReceived(ctx context.Context) {
-	m.messagesReceived.Add(ctx, 1)
+func targetAttributes(target string) metric.MeasurementOption {
+	return metric.WithAttributes(attribute.String(attributeTargetId, target))
+}
+
+func (m *OtelMeters) RecordMessagesReceived(ctx context.Context, target string) {
+	m.messagesReceived.Add(ctx, 1, targetAttributes(target))
+}
+
+func (m *OtelMeters) RecordMessagesAcked(ctx context.Context, target string) {
+	m.messagesAcked.Add(ctx, 1, targetAttributes(target))
+}
+
+func (m *OtelMeters) RecordMessagesForwardedToAdapter(ctx context.Context, target string) {
+	m.messagesForwardedToAdapter.Add(ctx, 1, targetAttributes(target))
+}
+
+func (m *OtelMeters) RecordMessagesRequeued(ctx context.Context, target string) {
+	m.messagesRequeued.Add(ctx, 1, targetAttributes(target))
+}
+
+func (m *OtelMeters) RecordTargetBuffer(ctx context.Context, target string, current int64, max int64) {
+	m.targetBufferCount.Record(ctx, current, targetAttributes(target))
+	m.targetBufferMax.Record(ctx, max, targetAttributes(target))
+}
+
+func pipelineAttributes(pipeline string) metric.MeasurementOption {
+	return metric.WithAttributes(attribute.String(attributePipeline, pipeline))
+}
+
+func (m *OtelMeters) RecordMessagesDropped(ctx context.Context, pipeline string) {
+	m.messagesDropped.Add(ctx, 1, pipelineAttributes(pipeline))
+}
+
+func (m *OtelMeters) RecordMessagesDeduplicated(ctx context.Context, pipeline string) {
+	m.messagesDeduplicated.Add(ctx, 1, pipelineAttributes(pipeline))
 }
 
-func (m *OtelMeters) RecordMessagesAcked(ctx context.Context) {
-	m.messagesAcked.Add(ctx, 1)
+func (m *OtelMeters) RecordMessagesQuarantined(ctx context.Context, pipeline string) {
+	m.messagesQuarantined.Add(ctx, 1, pipelineAttributes(pipeline))
 }
 
-func (m *OtelMeters) RecordMessagesForwardedToAdapter(ctx context.Context) {
-	m.messagesForwardedToAdapter.Add(ctx, 1)
+func (m *OtelMeters) RecordCircuitBreakerState(ctx context.Context, adapter string, state int64) {
+	m.circuitBreakerState.Record(ctx, state, metric.WithAttributes(attribute.String(attributeAdapter, adapter)))
 }
@@ -7,8 +7,20 @@ var _ Meters = (*Noop)(nil)
 
 type Noop struct{}
 
-func (Noop) RecordMessagesReceived(context.Context) {}
+func (Noop) RecordMessagesReceived(context.Context, string) {}
 
-func (Noop) RecordMessagesAcked(context.Context) {}
+func (Noop) RecordMessagesAcked(context.Context, string) {}
 
-func (Noop) RecordMessagesForwardedToAdapter(context.Context) {}
+func (Noop) RecordMessagesForwardedToAdapter(context.Context, string) {}
+
+func (Noop) RecordMessagesRequeued(context.Context, string) {}
+
+func (Noop) RecordTargetBuffer(context.Context, string, int64, int64) {}
+
+func (Noop) RecordMessagesDropped(context.Context, string) {}
+
+func (Noop) RecordMessagesDeduplicated(context.Context, string) {}
+
+func (Noop) RecordMessagesQuarantined(context.Context, string) {}
+
+func (Noop) RecordCircuitBreakerState(context.Context, string, int64) {}
@@ -0,0 +1,193 @@
+// Package pipeline routes messages from a stream through processors to one or more sinks.
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/blockdaemon/chain_sink/pkg/metrics"
+	"github.com/blockdaemon/chain_sink/pkg/stream"
+	"golang.org/x/sync/errgroup"
+)
+
+// Processor processes a message before it is forwarded to the sinks. It returns the message to forward, which may be
+// the input message or a new one. Returning a nil message drops it, dropped messages are still acknowledged.
+// Returning an error stops the stream, like an adapter error does.
+type Processor interface {
+	Process(ctx context.Context, message []byte) ([]byte, error)
+}
+
+// CompletionObserver is implemented by processors that need to know the outcome of the messages they processed.
+// Completed is called with the message as it was passed to Process once all sinks completed it, or with a nil error
+// once it was dropped by a later processor.
+type CompletionObserver interface {
+	Completed(ctx context.Context, message []byte, err error)
+}
+
+var _ stream.AsyncAdapter = (*Pipeline)(nil)
+var _ stream.Lifecycle = (*Pipeline)(nil)
+
+// Pipeline is an adapter that runs the processors in order and forwards the result to every sink. A message is
+// only completed once all sinks completed it. The pipeline does not own the sinks, their lifecycle is managed
+// separately since sinks may be shared between pipelines. Processors that implement stream.Lifecycle are started,
+// flushed and closed with the pipeline.
+type Pipeline struct {
+	name       string
+	processors []Processor
+	sinks      []stream.Adapter
+}
+
+func New(name string, processors []Processor, sinks []stream.Adapter) *Pipeline {
+	return &Pipeline{
+		name:       name,
+		processors: processors,
+		sinks:      sinks,
+	}
+}
+
+func (p *Pipeline) Name() string {
+	return p.name
+}
+
+// observed is a message passed to a CompletionObserver.
+type observed struct {
+	observer CompletionObserver
+	message  []byte
+}
+
+// process runs the processors, it returns the processed message or nil if it was dropped, and the messages to pass
+// to the observers once the message completed.
+func (p *Pipeline) process(ctx context.Context, message []byte) ([]byte, []observed, error) {
+	var observers []observed
+	for _, processor := range p.processors {
+		if observer, ok := processor.(CompletionObserver); ok {
+			observers = append(observers, observed{observer: observer, message: message})
+		}
+
+		var err error
+		if message, err = processor.Process(ctx, message); err != nil {
+			complete(ctx, observers, err)
+			return nil, nil, err
+		}
+		if message == nil {
+			metrics.G.RecordMessagesDropped(ctx, p.name)
+			complete(ctx, observers, nil)
+			return nil, nil, nil
+		}
+	}
+	return message, observers, nil
+}
+
+func complete(ctx context.Context, observers []observed, err error) {
+	for _, o := range observers {
+		o.observer.Completed(ctx, o.message, err)
+	}
+}
+
+func (p *Pipeline) HandleMessage(ctx context.Context, message []byte) error {
+	message, observers, err := p.process(ctx, message)
+	if err != nil || message == nil {
+		return err
+	}
+
+	for _, sink := range p.sinks {
+		if err = sink.HandleMessage(ctx, message); err != nil {
+			break
+		}
+	}
+	complete(ctx, observers, err)
+	return err
+}
+
+// HandleMessageAsync processes the message and forwards it to the sinks, async sinks are not waited for. Once the
+// message is handed to the sinks all errors are reported through done.
+func (p *Pipeline) HandleMessageAsync(ctx context.Context, message []byte, done func(error)) error {
+	message, observers, err := p.process(ctx, message)
+	if err != nil {
+		return err
+	}
+	if message == nil || len(p.sinks) == 0 {
+		complete(ctx, observers, nil)
+		done(nil)
+		return nil
+	}
+
+	if len(observers) > 0 {
+		onDone := done
+		done = func(err error) {
+			complete(ctx, observers, err)
+			onDone(err)
+		}
+	}
+
+	completion := newFanIn(len(p.sinks), done)
+	for _, sink := range p.sinks {
+		if asyncSink, ok := sink.(stream.AsyncAdapter); ok {
+			if err := asyncSink.HandleMessageAsync(ctx, message, completion.done); err != nil {
+				completion.done(err)
+			}
+			continue
+		}
+		completion.done(sink.HandleMessage(ctx, message))
+	}
+	return nil
+}
+
+// fanIn calls done with the first error once all expected completions are received.
+type fanIn struct {
+	sync.Mutex
+	remaining int
+	err       error
+	onDone    func(error)
+}
+
+func newFanIn(expected int, done func(error)) *fanIn {
+	return &fanIn{remaining: expected, onDone: done}
+}
+
+func (f *fanIn) done(err error) {
+	f.Lock()
+	if f.err == nil {
+		f.err = err
+	}
+	f.remaining--
+	finished := f.remaining == 0
+	f.Unlock()
+
+	if finished {
+		f.onDone(f.err)
+	}
+}
+
+func (p *Pipeline) Start(ctx context.Context) error {
+	group, gCtx := errgroup.WithContext(ctx)
+	for _, processor := range p.processors {
+		if lifecycle, ok := processor.(stream.Lifecycle); ok {
+			group.Go(func() error {
+				return lifecycle.Start(gCtx)
+			})
+		}
+	}
+	return group.Wait()
+}
+
+func (p *Pipeline) Flush(ctx context.Context) error {
+	var errs []error
+	for _, processor := range p.processors {
+		if lifecycle, ok := processor.(stream.Lifecycle); ok {
+			errs = append(errs, lifecycle.Flush(ctx))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p *Pipeline) Close(ctx context.Context) error {
+	var errs []error
+	for _, processor := range p.processors {
+		if lifecycle, ok := processor.(stream.Lifecycle); ok {
+			errs = append(errs, lifecycle.Close(ctx))
+		}
+	}
+	return errors.Join(errs...)
+}
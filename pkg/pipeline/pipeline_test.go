@@ -0,0 +1,136 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/blockdaemon/chain_sink/pkg/stream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type processorFunc func(ctx context.Context, message []byte) ([]byte, error)
+
+func (f processorFunc) Process(ctx context.Context, message []byte) ([]byte, error) {
+	return f(ctx, message)
+}
+
+type recordingSink struct {
+	messages [][]byte
+	err      error
+}
+
+func (s *recordingSink) HandleMessage(_ context.Context, message []byte) error {
+	s.messages = append(s.messages, message)
+	return s.err
+}
+
+// asyncSink completes messages when complete is called.
+type asyncSink struct {
+	recordingSink
+	pending []func(error)
+}
+
+func (s *asyncSink) HandleMessageAsync(_ context.Context, message []byte, done func(error)) error {
+	s.messages = append(s.messages, message)
+	s.pending = append(s.pending, done)
+	return nil
+}
+
+func (s *asyncSink) complete(err error) {
+	for _, done := range s.pending {
+		done(err)
+	}
+	s.pending = nil
+}
+
+var upper = processorFunc(func(_ context.Context, message []byte) ([]byte, error) {
+	return bytes.ToUpper(message), nil
+})
+
+var dropB = processorFunc(func(_ context.Context, message []byte) ([]byte, error) {
+	if bytes.Contains(message, []byte("b")) {
+		return nil, nil
+	}
+	return message, nil
+})
+
+func TestPipeline_HandleMessage(t *testing.T) {
+	first, second := &recordingSink{}, &recordingSink{}
+	p := New("test", []Processor{dropB, upper}, []stream.Adapter{first, second})
+
+	require.NoError(t, p.HandleMessage(context.Background(), []byte("a")))
+	require.NoError(t, p.HandleMessage(context.Background(), []byte("b")))
+
+	assert.Equal(t, [][]byte{[]byte("A")}, first.messages)
+	assert.Equal(t, [][]byte{[]byte("A")}, second.messages)
+
+	second.err = errors.New("sink failed")
+	assert.EqualError(t, p.HandleMessage(context.Background(), []byte("c")), "sink failed")
+}
+
+func TestPipeline_HandleMessageAsync(t *testing.T) {
+	sync, async := &recordingSink{}, &asyncSink{}
+	p := New("test", []Processor{dropB, upper}, []stream.Adapter{sync, async})
+
+	var results []error
+	done := func(err error) { results = append(results, err) }
+
+	require.NoError(t, p.HandleMessageAsync(context.Background(), []byte("b"), done))
+	assert.Equal(t, []error{nil}, results, "dropped messages complete immediately")
+
+	require.NoError(t, p.HandleMessageAsync(context.Background(), []byte("a"), done))
+	assert.Len(t, results, 1, "waits for the async sink")
+	assert.Equal(t, [][]byte{[]byte("A")}, sync.messages)
+	assert.Equal(t, [][]byte{[]byte("A")}, async.messages)
+
+	async.complete(nil)
+	assert.Equal(t, []error{nil, nil}, results)
+
+	sinkErr := errors.New("sink failed")
+	sync.err = sinkErr
+	require.NoError(t, p.HandleMessageAsync(context.Background(), []byte("c"), done))
+	async.complete(nil)
+	assert.Equal(t, []error{nil, nil, sinkErr}, results)
+}
+
+func TestPipeline_processorError(t *testing.T) {
+	processorErr := errors.New("processor failed")
+	sink := &recordingSink{}
+	p := New("test", []Processor{processorFunc(func(context.Context, []byte) ([]byte, error) {
+		return nil, processorErr
+	})}, []stream.Adapter{sink})
+
+	assert.ErrorIs(t, p.HandleMessage(context.Background(), []byte("a")), processorErr)
+	assert.ErrorIs(t, p.HandleMessageAsync(context.Background(), []byte("a"), func(error) {
+		t.Fatal("done must not be called")
+	}), processorErr)
+	assert.Empty(t, sink.messages)
+}
+
+type observingProcessor struct {
+	completed []string
+}
+
+func (p *observingProcessor) Process(_ context.Context, message []byte) ([]byte, error) {
+	return message, nil
+}
+
+func (p *observingProcessor) Completed(_ context.Context, message []byte, err error) {
+	p.completed = append(p.completed, fmt.Sprintf("%s:%v", message, err))
+}
+
+func TestPipeline_CompletionObserver(t *testing.T) {
+	observer, sink := &observingProcessor{}, &asyncSink{}
+	p := New("test", []Processor{observer, dropB, upper}, []stream.Adapter{sink})
+
+	require.NoError(t, p.HandleMessageAsync(context.Background(), []byte("b"), func(error) {}))
+	require.NoError(t, p.HandleMessageAsync(context.Background(), []byte("a"), func(error) {}))
+	assert.Equal(t, []string{"b:<nil>"}, observer.completed, "dropped messages complete immediately")
+
+	sink.complete(errors.New("sink failed"))
+	assert.Equal(t, []string{"b:<nil>", "a:sink failed"}, observer.completed, "observers get the message they processed")
+}
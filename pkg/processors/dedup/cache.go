@@ -0,0 +1,143 @@
+package dedup
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// cache is a bounded LRU set of keys that expire after a TTL.
+type cache struct {
+	sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	// order holds the entries from the most to the least recently seen.
+	order *list.List
+}
+
+type entry struct {
+	Key     string    `json:"key"`
+	Expires time.Time `json:"expires"`
+}
+
+func newCache(size int, ttl time.Duration) *cache {
+	return &cache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element, size),
+		order:   list.New(),
+	}
+}
+
+// contains reports whether the key was added and did not expire yet, a hit marks the key as recently seen without
+// extending its expiry.
+func (c *cache) contains(key string, now time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	if now.After(element.Value.(*entry).Expires) {
+		c.remove(element)
+		return false
+	}
+	c.order.MoveToFront(element)
+	return true
+}
+
+func (c *cache) add(key string, now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.set(entry{Key: key, Expires: now.Add(c.ttl)})
+}
+
+// set adds or refreshes the entry and evicts the least recently seen entries above the size.
+func (c *cache) set(e entry) {
+	if element, ok := c.entries[e.Key]; ok {
+		element.Value.(*entry).Expires = e.Expires
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[e.Key] = c.order.PushFront(&e)
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *cache) remove(element *list.Element) {
+	delete(c.entries, element.Value.(*entry).Key)
+	c.order.Remove(element)
+}
+
+func (c *cache) len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.order.Len()
+}
+
+// save writes the entries that did not expire to the file, the file is replaced atomically.
+func (c *cache) save(path string, now time.Time) error {
+	c.Lock()
+	entries := make([]entry, 0, c.order.Len())
+	for element := c.order.Back(); element != nil; element = element.Prev() {
+		if e := element.Value.(*entry); now.Before(e.Expires) {
+			entries = append(entries, *e)
+		}
+	}
+	c.Unlock()
+
+	raw, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("error creating dedup file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(raw); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("error writing dedup file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing dedup file: %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// load adds the entries of a file written by save, a missing file is not an error.
+func (c *cache) load(path string, now time.Time) error {
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading dedup file: %w", err)
+	}
+
+	var entries []entry
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return fmt.Errorf("error parsing dedup file: %w", err)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	// The entries are saved from the least to the most recently seen, so the order is restored.
+	for _, e := range entries {
+		if now.Before(e.Expires) {
+			c.set(e)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+// Package dedup drops messages that were already delivered, such as redeliveries after a reconnect.
+package dedup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/blockdaemon/chain_sink/pkg/clock"
+	"github.com/blockdaemon/chain_sink/pkg/logger"
+	"github.com/blockdaemon/chain_sink/pkg/metrics"
+	"github.com/blockdaemon/chain_sink/pkg/pipeline"
+	"github.com/blockdaemon/chain_sink/pkg/stream"
+	"github.com/valyala/fastjson"
+	"go.uber.org/zap"
+)
+
+type Config struct {
+	// KeyPath is the dot separated path of the key, it defaults to the Chain Watch message id.
+	KeyPath string `mapstructure:"key_path" default:"id"`
+	// Size is the maximum number of keys that are remembered, the least recently seen keys are evicted first.
+	Size int           `mapstructure:"size" default:"100000" validate:"gte=1"`
+	TTL  time.Duration `mapstructure:"ttl" default:"1h"`
+	// PersistFile is written every PersistInterval and on shutdown, and loaded on startup.
+	PersistFile     string        `mapstructure:"persist_file"`
+	PersistInterval time.Duration `mapstructure:"persist_interval" default:"30s"`
+}
+
+var _ pipeline.Processor = (*Dedup)(nil)
+var _ pipeline.CompletionObserver = (*Dedup)(nil)
+var _ stream.Lifecycle = (*Dedup)(nil)
+
+// Dedup drops messages with a key that was seen before. A key is only remembered once the message was delivered to
+// all sinks, so a message that failed is not dropped when it is redelivered.
+type Dedup struct {
+	cfg      Config
+	pipeline string
+	keyPath  []string
+	seen     *cache
+	clock    clock.Clock
+}
+
+// New creates a dedup processor and loads the persisted keys, pipelineName labels the metrics. The expiry of the keys
+// is measured with clk.
+func New(cfg Config, pipelineName string, clk clock.Clock) (*Dedup, error) {
+	d := &Dedup{
+		cfg:      cfg,
+		pipeline: pipelineName,
+		keyPath:  strings.Split(cfg.KeyPath, "."),
+		seen:     newCache(cfg.Size, cfg.TTL),
+		clock:    clk,
+	}
+
+	if cfg.PersistFile != "" {
+		if err := d.seen.load(cfg.PersistFile, d.clock.Now()); err != nil {
+			return nil, err
+		}
+		logger.Log.Info("loaded dedup keys", zap.String("pipeline", pipelineName), zap.Int("keys", d.seen.len()))
+	}
+
+	return d, nil
+}
+
+var parserPool = fastjson.ParserPool{}
+
+// key returns the key of the message, ok is false if the message has no key.
+func (d *Dedup) key(message []byte) (key string, ok bool, err error) {
+	parser := parserPool.Get()
+	defer parserPool.Put(parser)
+
+	parsed, err := parser.ParseBytes(message)
+	if err != nil {
+		return "", false, fmt.Errorf("error parsing message: %w", err)
+	}
+
+	value := parsed.Get(d.keyPath...)
+	if value == nil {
+		return "", false, nil
+	}
+	if value.Type() == fastjson.TypeString {
+		return string(value.GetStringBytes()), true, nil
+	}
+	return value.String(), true, nil
+}
+
+// Process drops the message if its key was seen, messages without a key are not deduplicated.
+func (d *Dedup) Process(ctx context.Context, message []byte) ([]byte, error) {
+	key, ok, err := d.key(message)
+	if err != nil || !ok {
+		return message, err
+	}
+
+	if d.seen.contains(key, d.clock.Now()) {
+		metrics.G.RecordMessagesDeduplicated(ctx, d.pipeline)
+		return nil, nil
+	}
+	return message, nil
+}
+
+// Completed remembers the key of a message that was delivered or dropped by a later processor.
+func (d *Dedup) Completed(_ context.Context, message []byte, err error) {
+	if err != nil {
+		return
+	}
+	if key, ok, _ := d.key(message); ok {
+		d.seen.add(key, d.clock.Now())
+	}
+}
+
+// Start persists the keys every PersistInterval until ctx is cancelled.
+func (d *Dedup) Start(ctx context.Context) error {
+	if d.cfg.PersistFile == "" {
+		return nil
+	}
+
+	ticker := time.NewTicker(d.cfg.PersistInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := d.persist(); err != nil {
+				logger.Log.Error("error persisting dedup keys", zap.String("pipeline", d.pipeline), zap.Error(err))
+			}
+		}
+	}
+}
+
+func (d *Dedup) persist() error {
+	if d.cfg.PersistFile == "" {
+		return nil
+	}
+	return d.seen.save(d.cfg.PersistFile, d.clock.Now())
+}
+
+func (d *Dedup) Flush(context.Context) error {
+	return d.persist()
+}
+
+func (d *Dedup) Close(context.Context) error {
+	return d.persist()
+}
@@ -0,0 +1,83 @@
+package dedup
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blockdaemon/chain_sink/pkg/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDedup(t *testing.T, cfg Config, testClock *clock.Fake) *Dedup {
+	d, err := New(cfg, "test", testClock)
+	require.NoError(t, err)
+	return d
+}
+
+// deliver processes the message and completes it like the pipeline does, it reports whether it was forwarded.
+func deliver(t *testing.T, d *Dedup, message string, err error) bool {
+	result, processErr := d.Process(context.Background(), []byte(message))
+	require.NoError(t, processErr)
+	d.Completed(context.Background(), []byte(message), err)
+	return result != nil
+}
+
+func TestDedup_Process(t *testing.T) {
+	testClock := clock.NewFake(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	d := newTestDedup(t, Config{KeyPath: "id", Size: 2, TTL: time.Minute}, testClock)
+
+	assert.True(t, deliver(t, d, `{"id":"a"}`, nil))
+	assert.False(t, deliver(t, d, `{"id":"a"}`, nil), "duplicate")
+	assert.True(t, deliver(t, d, `{"other":"a"}`, nil), "messages without key are forwarded")
+	assert.True(t, deliver(t, d, `{"other":"a"}`, nil), "messages without key are forwarded")
+
+	assert.True(t, deliver(t, d, `{"id":"b"}`, errors.New("sink failed")))
+	assert.True(t, deliver(t, d, `{"id":"b"}`, nil), "failed messages are not remembered")
+
+	assert.True(t, deliver(t, d, `{"id":"c"}`, nil))
+	assert.True(t, deliver(t, d, `{"id":"a"}`, nil), "least recently seen key is evicted")
+
+	testClock.Advance(2 * time.Minute)
+	assert.True(t, deliver(t, d, `{"id":"c"}`, nil), "expired")
+}
+
+func TestDedup_leastRecentlySeen(t *testing.T) {
+	d := newTestDedup(t, Config{KeyPath: "id", Size: 2, TTL: time.Minute}, clock.NewFake(time.Now()))
+
+	assert.True(t, deliver(t, d, `{"id":"a"}`, nil))
+	assert.True(t, deliver(t, d, `{"id":"b"}`, nil))
+	assert.False(t, deliver(t, d, `{"id":"a"}`, nil), "duplicate")
+	assert.True(t, deliver(t, d, `{"id":"c"}`, nil))
+	assert.False(t, deliver(t, d, `{"id":"a"}`, nil), "the duplicate made a recently seen")
+	assert.True(t, deliver(t, d, `{"id":"b"}`, nil), "b was least recently seen and evicted")
+}
+
+func TestDedup_keyPath(t *testing.T) {
+	d := newTestDedup(t, Config{KeyPath: "tx.hash", Size: 10, TTL: time.Minute}, clock.NewFake(time.Now()))
+
+	assert.True(t, deliver(t, d, `{"id":"1","tx":{"hash":"0x01"}}`, nil))
+	assert.False(t, deliver(t, d, `{"id":"2","tx":{"hash":"0x01"}}`, nil))
+	assert.True(t, deliver(t, d, `{"id":"3","tx":{"hash":1}}`, nil))
+	assert.False(t, deliver(t, d, `{"id":"4","tx":{"hash":1}}`, nil))
+}
+
+func TestDedup_persist(t *testing.T) {
+	testClock := clock.NewFake(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	cfg := Config{KeyPath: "id", Size: 10, TTL: time.Minute, PersistFile: filepath.Join(t.TempDir(), "dedup.json")}
+
+	d := newTestDedup(t, cfg, testClock)
+	assert.True(t, deliver(t, d, `{"id":"a"}`, nil))
+	testClock.Advance(30 * time.Second)
+	assert.True(t, deliver(t, d, `{"id":"b"}`, nil))
+	require.NoError(t, d.Close(context.Background()))
+
+	testClock.Advance(45 * time.Second)
+	restarted := newTestDedup(t, cfg, testClock)
+	assert.Equal(t, 1, restarted.seen.len())
+	assert.True(t, deliver(t, restarted, `{"id":"a"}`, nil), "expired before restart")
+	assert.False(t, deliver(t, restarted, `{"id":"b"}`, nil))
+}
@@ -0,0 +1,520 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fastjson"
+)
+
+// The expression language is a small boolean language over the message JSON:
+//
+//	expr       = or
+//	or         = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | comparison
+//	comparison = operand [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" ) operand | "in" list ]
+//	operand    = literal | path | "has(" path ")" | "(" expr ")"
+//	list       = "[" [ literal { "," literal } ] "]"
+//	path       = ident { "." ident | "[" ( integer | string ) "]" }
+//
+// Literals are strings in single or double quotes, numbers, true, false and null. A path that does not exist
+// evaluates to null. Numbers compare with strings holding a number, since Chain Watch encodes large numbers, such
+// as block numbers, as strings.
+
+// Expression is a compiled filter expression.
+type Expression struct {
+	source string
+	eval   func(v *fastjson.Value) value
+}
+
+// Compile parses an expression, it returns an error that contains the position of a syntax error.
+func Compile(source string) (*Expression, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	eval, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s at position %d", t, t.pos)
+	}
+
+	return &Expression{source: source, eval: eval}, nil
+}
+
+// Match evaluates the expression against a parsed message, only a boolean true result matches.
+func (e *Expression) Match(v *fastjson.Value) bool {
+	result := e.eval(v)
+	return result.kind == kindBool && result.b
+}
+
+func (e *Expression) String() string {
+	return e.source
+}
+
+type kind uint8
+
+const (
+	kindNull kind = iota
+	kindBool
+	kindNumber
+	kindString
+	// kindJSON is an object or array, which is only compared by its JSON encoding.
+	kindJSON
+)
+
+type value struct {
+	kind kind
+	b    bool
+	n    float64
+	s    string
+	json *fastjson.Value
+}
+
+func fromJSON(v *fastjson.Value) value {
+	if v == nil {
+		return value{kind: kindNull}
+	}
+	switch v.Type() {
+	case fastjson.TypeTrue:
+		return value{kind: kindBool, b: true}
+	case fastjson.TypeFalse:
+		return value{kind: kindBool, b: false}
+	case fastjson.TypeNumber:
+		return value{kind: kindNumber, n: v.GetFloat64()}
+	case fastjson.TypeString:
+		return value{kind: kindString, s: string(v.GetStringBytes())}
+	case fastjson.TypeObject, fastjson.TypeArray:
+		return value{kind: kindJSON, json: v}
+	default:
+		return value{kind: kindNull}
+	}
+}
+
+func boolValue(b bool) value {
+	return value{kind: kindBool, b: b}
+}
+
+// number returns the numeric value of numbers and of strings that hold a number.
+func (v value) number() (float64, bool) {
+	switch v.kind {
+	case kindNumber:
+		return v.n, true
+	case kindString:
+		n, err := strconv.ParseFloat(v.s, 64)
+		return n, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func equal(a, b value) bool {
+	if a.kind == kindNumber || b.kind == kindNumber {
+		an, aok := a.number()
+		bn, bok := b.number()
+		return aok && bok && an == bn
+	}
+	if a.kind != b.kind {
+		return false
+	}
+	switch a.kind {
+	case kindNull:
+		return true
+	case kindBool:
+		return a.b == b.b
+	case kindString:
+		return a.s == b.s
+	default:
+		return a.json.String() == b.json.String()
+	}
+}
+
+// compare returns the ordering of a and b, ok is false when the values can not be ordered.
+func compare(a, b value) (result int, ok bool) {
+	if a.kind == kindString && b.kind == kindString {
+		return strings.Compare(a.s, b.s), true
+	}
+	an, aok := a.number()
+	bn, bok := b.number()
+	if !aok || !bok {
+		return 0, false
+	}
+	switch {
+	case an < bn:
+		return -1, true
+	case an > bn:
+		return 1, true
+	default:
+		return 0, true
+	}
+}
+
+type tokenKind uint8
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ".", ","}
+
+func tokenize(source string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			end := i + 1
+			var text strings.Builder
+			for ; end < len(source) && source[end] != c; end++ {
+				if source[end] == '\\' && end+1 < len(source) {
+					end++
+				}
+				text.WriteByte(source[end])
+			}
+			if end >= len(source) {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			tokens = append(tokens, token{kind: tokenString, text: text.String(), pos: i})
+			i = end + 1
+		case c == '-' || (c >= '0' && c <= '9'):
+			end := i + 1
+			for end < len(source) && (source[end] >= '0' && source[end] <= '9' || source[end] == '.' || source[end] == 'e' || source[end] == 'E') {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: source[i:end], pos: i})
+			i = end
+		case isIdentChar(c):
+			end := i + 1
+			for end < len(source) && (isIdentChar(source[end]) || source[end] >= '0' && source[end] <= '9') {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: source[i:end], pos: i})
+			i = end
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(source[i:], op) {
+					tokens = append(tokens, token{kind: tokenOperator, text: op, pos: i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+			}
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(source)}), nil
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+type evalFunc = func(v *fastjson.Value) value
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is the operator or keyword op.
+func (p *parser) accept(op string) bool {
+	t := p.peek()
+	if (t.kind == tokenOperator || t.kind == tokenIdent) && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.accept(op) {
+		t := p.peek()
+		return fmt.Errorf("expected %q, got %s at position %d", op, t, t.pos)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (evalFunc, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(v *fastjson.Value) value {
+			return boolValue(truthy(l(v)) || truthy(right(v)))
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (evalFunc, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(v *fastjson.Value) value {
+			return boolValue(truthy(l(v)) && truthy(right(v)))
+		}
+	}
+	return left, nil
+}
+
+func truthy(v value) bool {
+	return v.kind == kindBool && v.b
+}
+
+func (p *parser) parseUnary() (evalFunc, error) {
+	if p.accept("!") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(v *fastjson.Value) value {
+			return boolValue(!truthy(operand(v)))
+		}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (evalFunc, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.accept("in") {
+		list, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		return func(v *fastjson.Value) value {
+			l := left(v)
+			for _, item := range list {
+				if equal(l, item) {
+					return boolValue(true)
+				}
+			}
+			return boolValue(false)
+		}, nil
+	}
+
+	t := p.peek()
+	if t.kind != tokenOperator {
+		return left, nil
+	}
+
+	var test func(a, b value) bool
+	switch t.text {
+	case "==":
+		test = equal
+	case "!=":
+		test = func(a, b value) bool { return !equal(a, b) }
+	case "<", "<=", ">", ">=":
+		op := t.text
+		test = func(a, b value) bool {
+			result, ok := compare(a, b)
+			if !ok {
+				return false
+			}
+			switch op {
+			case "<":
+				return result < 0
+			case "<=":
+				return result <= 0
+			case ">":
+				return result > 0
+			default:
+				return result >= 0
+			}
+		}
+	default:
+		return left, nil
+	}
+	p.next()
+
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return func(v *fastjson.Value) value {
+		return boolValue(test(left(v), right(v)))
+	}, nil
+}
+
+func (p *parser) parseOperand() (evalFunc, error) {
+	if p.accept("(") {
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	}
+
+	t := p.peek()
+	if t.kind == tokenIdent && t.text == "has" && p.tokens[p.pos+1].text == "(" {
+		p.pos += 2
+		path, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return func(v *fastjson.Value) value {
+			return boolValue(v.Get(path...) != nil)
+		}, nil
+	}
+
+	literal, ok, err := p.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return func(*fastjson.Value) value { return literal }, nil
+	}
+
+	path, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+	return func(v *fastjson.Value) value {
+		return fromJSON(v.Get(path...))
+	}, nil
+}
+
+// parseLiteral parses a literal, ok is false if the next token is not a literal.
+func (p *parser) parseLiteral() (literal value, ok bool, err error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokenString:
+		p.next()
+		return value{kind: kindString, s: t.text}, true, nil
+	case t.kind == tokenNumber:
+		p.next()
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return value{}, false, fmt.Errorf("invalid number %s at position %d", t, t.pos)
+		}
+		return value{kind: kindNumber, n: n}, true, nil
+	case t.kind == tokenIdent && (t.text == "true" || t.text == "false"):
+		p.next()
+		return boolValue(t.text == "true"), true, nil
+	case t.kind == tokenIdent && t.text == "null":
+		p.next()
+		return value{kind: kindNull}, true, nil
+	}
+	return value{}, false, nil
+}
+
+func (p *parser) parseList() ([]value, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	var list []value
+	if p.accept("]") {
+		return list, nil
+	}
+	for {
+		literal, ok, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			t := p.peek()
+			return nil, fmt.Errorf("expected literal, got %s at position %d", t, t.pos)
+		}
+		list = append(list, literal)
+		if p.accept("]") {
+			return list, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parsePath parses a path into the keys for fastjson.Value.Get, array indexes are keys as well.
+func (p *parser) parsePath() ([]string, error) {
+	t := p.next()
+	if t.kind != tokenIdent {
+		return nil, fmt.Errorf("expected field, got %s at position %d", t, t.pos)
+	}
+	path := []string{t.text}
+
+	for {
+		switch {
+		case p.accept("."):
+			t := p.next()
+			if t.kind != tokenIdent {
+				return nil, fmt.Errorf("expected field, got %s at position %d", t, t.pos)
+			}
+			path = append(path, t.text)
+		case p.accept("["):
+			t := p.next()
+			if t.kind == tokenNumber {
+				if _, err := strconv.Atoi(t.text); err != nil {
+					return nil, fmt.Errorf("invalid index %s at position %d", t, t.pos)
+				}
+			} else if t.kind != tokenString {
+				return nil, fmt.Errorf("expected index or key, got %s at position %d", t, t.pos)
+			}
+			path = append(path, t.text)
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+		default:
+			return path, nil
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fastjson"
+)
+
+const testMessage = `{
+	"id": "f5b1c7e2",
+	"event": "transfer",
+	"block": {"number": "19000000", "hash": "0xabc"},
+	"confirmed": true,
+	"value": 12.5,
+	"logs": [{"address": "0x01"}, {"address": "0x02"}],
+	"meta": {"dotted.key": "x"},
+	"empty": null
+}`
+
+func TestExpression_Match(t *testing.T) {
+	parsed := fastjson.MustParse(testMessage)
+
+	tests := []struct {
+		expression string
+		match      bool
+	}{
+		{`event == "transfer"`, true},
+		{`event == 'approval'`, false},
+		{`event != "approval"`, true},
+		{`confirmed`, true},
+		{`!confirmed`, false},
+		{`confirmed == true`, true},
+		{`value > 10`, true},
+		{`value <= 12.5`, true},
+		{`value < 12.5`, false},
+		{`block.number >= 19000000`, true},
+		{`block.number == 19000000`, true},
+		{`block.number > "1"`, true},
+		{`logs[1].address == "0x02"`, true},
+		{`logs[2].address == "0x03"`, false},
+		{`meta["dotted.key"] == "x"`, true},
+		{`event in ["transfer", "approval"]`, true},
+		{`event in []`, false},
+		{`has(block.hash)`, true},
+		{`has(block.parent)`, false},
+		{`has(empty)`, true},
+		{`empty == null`, true},
+		{`missing == null`, true},
+		{`missing > 1`, false},
+		{`event == "transfer" && value > 100`, false},
+		{`event == "transfer" && (value > 100 || confirmed)`, true},
+		{`event == "approval" || !has(missing)`, true},
+		{`event`, false},
+		{`logs == logs`, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			expression, err := Compile(test.expression)
+			require.NoError(t, err)
+			assert.Equal(t, test.match, expression.Match(parsed))
+		})
+	}
+}
+
+func TestCompile_errors(t *testing.T) {
+	tests := []struct {
+		expression string
+		err        string
+	}{
+		{``, `expected field, got end of expression at position 0`},
+		{`event ==`, `expected field, got end of expression at position 8`},
+		{`event == "transfer`, `unterminated string at position 9`},
+		{`(event == "a"`, `expected ")", got end of expression at position 13`},
+		{`event in "a"`, `expected "[", got "a" at position 9`},
+		{`event in [a]`, `expected literal, got "a" at position 10`},
+		{`event == "a" event`, `unexpected "event" at position 13`},
+		{`logs[x]`, `expected index or key, got "x" at position 5`},
+		{`event # 1`, `unexpected character '#' at position 6`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			_, err := Compile(test.expression)
+			assert.EqualError(t, err, test.err)
+		})
+	}
+}
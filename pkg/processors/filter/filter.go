@@ -0,0 +1,47 @@
+// Package filter drops messages that do not match an expression.
+package filter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/blockdaemon/chain_sink/pkg/pipeline"
+	"github.com/valyala/fastjson"
+)
+
+type Config struct {
+	// Expression is evaluated against every message, messages that do not match are dropped.
+	Expression string `mapstructure:"expression" validate:"required"`
+}
+
+var _ pipeline.Processor = (*Filter)(nil)
+
+type Filter struct {
+	expression *Expression
+}
+
+func New(cfg Config) (*Filter, error) {
+	expression, err := Compile(cfg.Expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter expression: %w", err)
+	}
+	return &Filter{expression: expression}, nil
+}
+
+var parserPool = fastjson.ParserPool{}
+
+// Process returns the message if it matches the expression and nil otherwise.
+func (f *Filter) Process(_ context.Context, message []byte) ([]byte, error) {
+	parser := parserPool.Get()
+	defer parserPool.Put(parser)
+
+	parsed, err := parser.ParseBytes(message)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing message: %w", err)
+	}
+
+	if !f.expression.Match(parsed) {
+		return nil, nil
+	}
+	return message, nil
+}
@@ -0,0 +1,26 @@
+package filter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter_Process(t *testing.T) {
+	filter, err := New(Config{Expression: `event == "transfer"`})
+	require.NoError(t, err)
+
+	message := []byte(`{"event":"transfer"}`)
+	result, err := filter.Process(context.Background(), message)
+	require.NoError(t, err)
+	assert.Equal(t, message, result)
+
+	result, err = filter.Process(context.Background(), []byte(`{"event":"approval"}`))
+	require.NoError(t, err)
+	assert.Nil(t, result)
+
+	_, err = New(Config{Expression: `event ==`})
+	assert.ErrorContains(t, err, "invalid filter expression")
+}
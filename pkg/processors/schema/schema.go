@@ -0,0 +1,155 @@
+// Package schema validates messages against JSON schemas and quarantines the messages that do not match.
+package schema
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/blockdaemon/chain_sink/pkg/chainwatch"
+	"github.com/blockdaemon/chain_sink/pkg/logger"
+	"github.com/blockdaemon/chain_sink/pkg/metrics"
+	"github.com/blockdaemon/chain_sink/pkg/pipeline"
+	"github.com/blockdaemon/chain_sink/pkg/stream"
+	"github.com/valyala/fastjson"
+	"github.com/xeipuuv/gojsonschema"
+	"go.uber.org/zap"
+)
+
+type Config struct {
+	// TypePath is the dot separated path of the event type, which selects the schema.
+	TypePath string   `mapstructure:"type_path" default:"type"`
+	Schemas  []Schema `mapstructure:"schemas" validate:"required,min=1,dive"`
+	// RequireSchema quarantines events of a type without a schema, they pass otherwise.
+	RequireSchema bool `mapstructure:"require_schema"`
+	// Quarantine is the name of the adapter invalid messages are handed to, they are dropped if empty.
+	Quarantine string `mapstructure:"quarantine"`
+}
+
+// Schema is a JSON schema file for an event type, a schema without a type applies to events of all other types.
+type Schema struct {
+	Type string `mapstructure:"type"`
+	File string `mapstructure:"file" validate:"required"`
+}
+
+var _ pipeline.Processor = (*Validator)(nil)
+
+// Validator passes the messages that match the schema of their event type. Invalid messages, including messages that
+// are not JSON, are handed to the quarantine adapter and dropped from the pipeline, so they are acknowledged once the
+// quarantine adapter handled them.
+type Validator struct {
+	cfg      Config
+	pipeline string
+	typePath []string
+	schemas  map[string]*gojsonschema.Schema
+	// fallback is the schema without a type, nil if there is none.
+	fallback   *gojsonschema.Schema
+	quarantine stream.Adapter
+}
+
+// New loads the schemas, quarantine is the adapter named by cfg.Quarantine and may be nil if none is configured.
+// pipelineName labels the metrics.
+func New(cfg Config, pipelineName string, quarantine stream.Adapter) (*Validator, error) {
+	v := &Validator{
+		cfg:        cfg,
+		pipeline:   pipelineName,
+		typePath:   strings.Split(cfg.TypePath, "."),
+		schemas:    make(map[string]*gojsonschema.Schema, len(cfg.Schemas)),
+		quarantine: quarantine,
+	}
+
+	for _, s := range cfg.Schemas {
+		// Schemas are loaded by absolute path so that relative $refs resolve next to the schema file.
+		path, err := filepath.Abs(s.File)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving schema file %s: %w", s.File, err)
+		}
+		schema, err := gojsonschema.NewSchema(gojsonschema.NewReferenceLoader("file://" + filepath.ToSlash(path)))
+		if err != nil {
+			return nil, fmt.Errorf("error loading schema file %s: %w", s.File, err)
+		}
+
+		if s.Type == "" {
+			if v.fallback != nil {
+				return nil, fmt.Errorf("only one schema without a type can be configured")
+			}
+			v.fallback = schema
+			continue
+		}
+		if _, ok := v.schemas[s.Type]; ok {
+			return nil, fmt.Errorf("duplicate schema for type %s", s.Type)
+		}
+		v.schemas[s.Type] = schema
+	}
+
+	return v, nil
+}
+
+var parserPool = fastjson.ParserPool{}
+
+// Process returns the message if it is valid and nil otherwise.
+func (v *Validator) Process(ctx context.Context, message []byte) ([]byte, error) {
+	eventType, reasons := v.validate(message)
+	if len(reasons) == 0 {
+		return message, nil
+	}
+
+	metrics.G.RecordMessagesQuarantined(ctx, v.pipeline)
+	logger.Log.Warn("quarantining invalid message", zap.String("pipeline", v.pipeline), zap.String("event_type", eventType),
+		zap.Strings("reasons", reasons), zap.ByteString(chainwatch.FieldId, messageId(message)))
+
+	if v.quarantine != nil {
+		if err := v.quarantine.HandleMessage(ctx, message); err != nil {
+			return nil, fmt.Errorf("error quarantining message: %w", err)
+		}
+	}
+	return nil, nil
+}
+
+// validate returns the event type of the message and the reasons it is invalid, which are empty if it is valid.
+func (v *Validator) validate(message []byte) (string, []string) {
+	parser := parserPool.Get()
+	parsed, err := parser.ParseBytes(message)
+	if err != nil {
+		parserPool.Put(parser)
+		return "", []string{fmt.Sprintf("invalid JSON: %s", err)}
+	}
+	eventType := string(parsed.GetStringBytes(v.typePath...))
+	parserPool.Put(parser)
+
+	schema, ok := v.schemas[eventType]
+	if !ok {
+		schema = v.fallback
+	}
+	if schema == nil {
+		if v.cfg.RequireSchema {
+			return eventType, []string{fmt.Sprintf("no schema for event type %q", eventType)}
+		}
+		return eventType, nil
+	}
+
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(message))
+	if err != nil {
+		return eventType, []string{err.Error()}
+	}
+
+	var reasons []string
+	for _, resultErr := range result.Errors() {
+		reasons = append(reasons, resultErr.String())
+	}
+	return eventType, reasons
+}
+
+// messageId returns the id of the message for logging, nil if the message has none.
+func messageId(message []byte) []byte {
+	parser := parserPool.Get()
+	defer parserPool.Put(parser)
+
+	view, err := chainwatch.Parse(parser, message)
+	if err != nil {
+		return nil
+	}
+	// The id points into the parser, which is reused after returning.
+	return append([]byte(nil), view.Id()...)
+}
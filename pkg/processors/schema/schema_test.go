@@ -0,0 +1,79 @@
+package schema
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type quarantineAdapter struct {
+	messages []string
+	err      error
+}
+
+func (a *quarantineAdapter) HandleMessage(_ context.Context, message []byte) error {
+	a.messages = append(a.messages, string(message))
+	return a.err
+}
+
+func TestValidator(t *testing.T) {
+	quarantine := &quarantineAdapter{}
+	validator, err := New(Config{TypePath: "type", Schemas: []Schema{{Type: "transfer", File: "testdata/transfer.json"}}}, "test", quarantine)
+	require.NoError(t, err)
+
+	valid := []string{
+		`{"id": "1", "type": "transfer", "version": 2, "payload": {"value": "0x1"}}`,
+		`{"id": "2", "type": "approval"}`,
+	}
+	for _, message := range valid {
+		result, err := validator.Process(context.Background(), []byte(message))
+		require.NoError(t, err)
+		assert.Equal(t, message, string(result))
+	}
+
+	invalid := []string{
+		`{"id": "3", "type": "transfer", "version": 3, "payload": {"value": "0x1"}}`,
+		`{"id": "4", "type": "transfer", "payload": {"value": 1}}`,
+		`{"id": "5", "type": "transfer"`,
+	}
+	for _, message := range invalid {
+		result, err := validator.Process(context.Background(), []byte(message))
+		require.NoError(t, err)
+		assert.Nil(t, result, message)
+	}
+	assert.Equal(t, invalid, quarantine.messages)
+
+	quarantine.err = errors.New("quarantine failed")
+	_, err = validator.Process(context.Background(), []byte(invalid[0]))
+	assert.EqualError(t, err, "error quarantining message: quarantine failed")
+}
+
+func TestValidator_requireSchema(t *testing.T) {
+	validator, err := New(Config{TypePath: "type", RequireSchema: true, Schemas: []Schema{{Type: "transfer", File: "testdata/transfer.json"}}}, "test", nil)
+	require.NoError(t, err)
+
+	result, err := validator.Process(context.Background(), []byte(`{"id": "1", "type": "approval"}`))
+	require.NoError(t, err)
+	assert.Nil(t, result, "events without a schema are dropped")
+
+	validator, err = New(Config{TypePath: "type", RequireSchema: true, Schemas: []Schema{{File: "testdata/event.json"}}}, "test", nil)
+	require.NoError(t, err)
+
+	result, err = validator.Process(context.Background(), []byte(`{"id": "1", "type": "approval"}`))
+	require.NoError(t, err)
+	assert.NotNil(t, result, "the schema without a type applies to all types")
+}
+
+func TestNew_errors(t *testing.T) {
+	_, err := New(Config{Schemas: []Schema{{File: "testdata/missing.json"}}}, "test", nil)
+	assert.ErrorContains(t, err, "error loading schema file testdata/missing.json")
+
+	_, err = New(Config{Schemas: []Schema{{File: "testdata/event.json"}, {File: "testdata/event.json"}}}, "test", nil)
+	assert.EqualError(t, err, "only one schema without a type can be configured")
+
+	_, err = New(Config{Schemas: []Schema{{Type: "a", File: "testdata/event.json"}, {Type: "a", File: "testdata/event.json"}}}, "test", nil)
+	assert.EqualError(t, err, "duplicate schema for type a")
+}
@@ -0,0 +1,243 @@
+// Package transform reshapes messages before they are forwarded to the sinks.
+package transform
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blockdaemon/chain_sink/pkg/clock"
+	"github.com/blockdaemon/chain_sink/pkg/pipeline"
+	"github.com/valyala/fastjson"
+)
+
+// Config configures the transform. Paths are dot separated object keys, e.g. `block.number`, array elements can
+// not be addressed.
+type Config struct {
+	// Select keeps only the given paths, all paths are kept if empty.
+	Select []string `mapstructure:"select"`
+	Drop   []string `mapstructure:"drop"`
+	Rename []Rename `mapstructure:"rename" validate:"dive"`
+	Add    []Field  `mapstructure:"add" validate:"dive"`
+	// Flatten replaces nested objects with their fields, the keys are joined with FlattenSeparator.
+	Flatten          bool   `mapstructure:"flatten"`
+	FlattenSeparator string `mapstructure:"flatten_separator" default:"."`
+}
+
+type Rename struct {
+	From string `mapstructure:"from" validate:"required"`
+	To   string `mapstructure:"to" validate:"required"`
+}
+
+type ComputedValue string
+
+const (
+	// ComputedReceivedAt is the time the message was processed, in RFC 3339 format.
+	ComputedReceivedAt ComputedValue = "received_at"
+	ComputedTargetId   ComputedValue = "target_id"
+	ComputedHostname   ComputedValue = "hostname"
+)
+
+// Field adds either a static Value or a Computed value at Path, overwriting an existing value. Value is a pointer so
+// that false, 0 and "" count as set.
+type Field struct {
+	Path     string        `mapstructure:"path" validate:"required"`
+	Value    *any          `mapstructure:"value" validate:"required_without=Computed"`
+	Computed ComputedValue `mapstructure:"computed" validate:"omitempty,oneof=received_at target_id hostname"`
+}
+
+var _ pipeline.Processor = (*Transform)(nil)
+
+// Transform applies, in order, select, drop, rename, add and flatten to every message.
+type Transform struct {
+	cfg    Config
+	sel    [][]string
+	drop   [][]string
+	rename [][2][]string
+	add    []field
+	clock  clock.Clock
+}
+
+type field struct {
+	path     []string
+	computed ComputedValue
+	// static is shared by all messages, which is safe since the value is a scalar that is only read.
+	static *fastjson.Value
+}
+
+// New creates a transform, targetId is used for the computed target_id field and clk for the computed timestamp.
+func New(cfg Config, targetId string, clk clock.Clock) (*Transform, error) {
+	t := &Transform{
+		cfg:   cfg,
+		sel:   splitPaths(cfg.Select),
+		drop:  splitPaths(cfg.Drop),
+		clock: clk,
+	}
+
+	for _, rename := range cfg.Rename {
+		t.rename = append(t.rename, [2][]string{splitPath(rename.From), splitPath(rename.To)})
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("error reading hostname: %w", err)
+	}
+
+	// The static values are allocated once and live as long as the transform.
+	var arena fastjson.Arena
+	for _, add := range cfg.Add {
+		f := field{path: splitPath(add.Path), computed: add.Computed}
+		switch add.Computed {
+		case "":
+			if add.Value == nil {
+				return nil, fmt.Errorf("field %s: value is required", add.Path)
+			}
+			if f.static, err = staticValue(&arena, *add.Value); err != nil {
+				return nil, fmt.Errorf("field %s: %w", add.Path, err)
+			}
+		case ComputedTargetId:
+			f.static = arena.NewString(targetId)
+		case ComputedHostname:
+			f.static = arena.NewString(hostname)
+		case ComputedReceivedAt:
+		default:
+			return nil, fmt.Errorf("field %s: unsupported computed value: %s", add.Path, add.Computed)
+		}
+		t.add = append(t.add, f)
+	}
+
+	if t.cfg.Flatten && t.cfg.FlattenSeparator == "" {
+		t.cfg.FlattenSeparator = "."
+	}
+
+	return t, nil
+}
+
+func splitPath(path string) []string {
+	return strings.Split(path, ".")
+}
+
+func splitPaths(paths []string) [][]string {
+	result := make([][]string, 0, len(paths))
+	for _, path := range paths {
+		result = append(result, splitPath(path))
+	}
+	return result
+}
+
+// staticValue converts a static value from the configuration into a JSON value.
+func staticValue(arena *fastjson.Arena, value any) (*fastjson.Value, error) {
+	switch v := value.(type) {
+	case string:
+		return arena.NewString(v), nil
+	case bool:
+		if v {
+			return arena.NewTrue(), nil
+		}
+		return arena.NewFalse(), nil
+	case int:
+		return arena.NewNumberInt(v), nil
+	case int64:
+		return arena.NewNumberString(strconv.FormatInt(v, 10)), nil
+	case float64:
+		return arena.NewNumberFloat64(v), nil
+	case nil:
+		return nil, fmt.Errorf("value is required")
+	default:
+		return nil, fmt.Errorf("unsupported value type %T", value)
+	}
+}
+
+var parserPool = fastjson.ParserPool{}
+var arenaPool = fastjson.ArenaPool{}
+
+func (t *Transform) Process(_ context.Context, message []byte) ([]byte, error) {
+	parser := parserPool.Get()
+	defer parserPool.Put(parser)
+
+	parsed, err := parser.ParseBytes(message)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing message: %w", err)
+	}
+	if parsed.Type() != fastjson.TypeObject {
+		return nil, fmt.Errorf("message is not an object")
+	}
+
+	arena := arenaPool.Get()
+	defer arenaPool.Put(arena)
+
+	root := parsed
+	if len(t.sel) > 0 {
+		root = arena.NewObject()
+		for _, path := range t.sel {
+			if v := parsed.Get(path...); v != nil {
+				setPath(arena, root, path, v)
+			}
+		}
+	}
+
+	for _, path := range t.drop {
+		deletePath(root, path)
+	}
+
+	for _, rename := range t.rename {
+		if v := root.Get(rename[0]...); v != nil {
+			deletePath(root, rename[0])
+			setPath(arena, root, rename[1], v)
+		}
+	}
+
+	for _, f := range t.add {
+		v := f.static
+		if f.computed == ComputedReceivedAt {
+			v = arena.NewString(t.clock.Now().UTC().Format(time.RFC3339Nano))
+		}
+		setPath(arena, root, f.path, v)
+	}
+
+	if t.cfg.Flatten {
+		flat := arena.NewObject()
+		flatten(flat, "", root, t.cfg.FlattenSeparator)
+		root = flat
+	}
+
+	// The result outlives the parser and arena, so it is marshalled into a new buffer.
+	return root.MarshalTo(make([]byte, 0, len(message))), nil
+}
+
+// setPath sets the value at path, creating or replacing intermediate values with objects.
+func setPath(arena *fastjson.Arena, root *fastjson.Value, path []string, v *fastjson.Value) {
+	obj := root
+	for _, key := range path[:len(path)-1] {
+		next := obj.Get(key)
+		if next == nil || next.Type() != fastjson.TypeObject {
+			next = arena.NewObject()
+			obj.Set(key, next)
+		}
+		obj = next
+	}
+	obj.Set(path[len(path)-1], v)
+}
+
+func deletePath(root *fastjson.Value, path []string) {
+	parent := root.Get(path[:len(path)-1]...)
+	if parent != nil && parent.Type() == fastjson.TypeObject {
+		parent.Del(path[len(path)-1])
+	}
+}
+
+// flatten sets the fields of nested objects on dst, prefixed by the keys of their parents. Empty objects and arrays
+// are kept as values.
+func flatten(dst *fastjson.Value, prefix string, v *fastjson.Value, separator string) {
+	v.GetObject().Visit(func(key []byte, child *fastjson.Value) {
+		name := prefix + string(key)
+		if child.Type() == fastjson.TypeObject && child.GetObject().Len() > 0 {
+			flatten(dst, name+separator, child, separator)
+			return
+		}
+		dst.Set(name, child)
+	})
+}
@@ -0,0 +1,107 @@
+package transform
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/blockdaemon/chain_sink/pkg/clock"
+	"github.com/go-playground/validator/v10"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testMessage = `{"id":"f5b1c7e2","event":"transfer","block":{"number":"19000000","hash":"0xabc","empty":{}},"logs":[1,2]}`
+
+// static returns a pointer to the static value of a field.
+func static(value any) *any {
+	return &value
+}
+
+func TestTransform_Validate(t *testing.T) {
+	validate := validator.New()
+	assert.NoError(t, validate.Struct(Field{Path: "a", Value: static(false)}), "false is a valid static value")
+	assert.NoError(t, validate.Struct(Field{Path: "a", Computed: ComputedHostname}))
+	assert.Error(t, validate.Struct(Field{Path: "a"}), "either value or computed is required")
+}
+
+func TestTransform_Process(t *testing.T) {
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		cfg      Config
+		expected string
+	}{
+		{
+			name:     "no changes",
+			cfg:      Config{},
+			expected: testMessage,
+		},
+		{
+			name:     "select",
+			cfg:      Config{Select: []string{"id", "block.number", "missing"}},
+			expected: `{"id":"f5b1c7e2","block":{"number":"19000000"}}`,
+		},
+		{
+			name:     "drop",
+			cfg:      Config{Drop: []string{"logs", "block.hash", "missing.field"}},
+			expected: `{"id":"f5b1c7e2","event":"transfer","block":{"number":"19000000","empty":{}}}`,
+		},
+		{
+			name:     "rename",
+			cfg:      Config{Select: []string{"id", "block.number"}, Rename: []Rename{{From: "block.number", To: "block_number"}, {From: "missing", To: "other"}}},
+			expected: `{"id":"f5b1c7e2","block":{},"block_number":"19000000"}`,
+		},
+		{
+			name: "add",
+			cfg: Config{Select: []string{"id"}, Add: []Field{
+				{Path: "source.target", Computed: ComputedTargetId},
+				{Path: "source.host", Computed: ComputedHostname},
+				{Path: "received_at", Computed: ComputedReceivedAt},
+				{Path: "version", Value: static(2)},
+				{Path: "id", Value: static("overwritten")},
+			}},
+			expected: `{"id":"overwritten","source":{"target":"target-1","host":"` + hostname + `"},"received_at":"2026-01-02T03:04:05Z","version":2}`,
+		},
+		{
+			name: "add zero values",
+			cfg: Config{Select: []string{"id"}, Add: []Field{
+				{Path: "removed", Value: static(false)},
+				{Path: "count", Value: static(0)},
+				{Path: "note", Value: static("")},
+			}},
+			expected: `{"id":"f5b1c7e2","removed":false,"count":0,"note":""}`,
+		},
+		{
+			name:     "flatten",
+			cfg:      Config{Drop: []string{"id"}, Flatten: true, FlattenSeparator: "_"},
+			expected: `{"event":"transfer","block_number":"19000000","block_hash":"0xabc","block_empty":{},"logs":[1,2]}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transform, err := New(test.cfg, "target-1", clock.NewFake(time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)))
+			require.NoError(t, err)
+
+			result, err := transform.Process(context.Background(), []byte(testMessage))
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, string(result))
+		})
+	}
+}
+
+func TestTransform_errors(t *testing.T) {
+	_, err := New(Config{Add: []Field{{Path: "a", Value: static([]any{1})}}}, "", clock.Real)
+	assert.EqualError(t, err, "field a: unsupported value type []interface {}")
+	_, err = New(Config{Add: []Field{{Path: "a"}}}, "", clock.Real)
+	assert.EqualError(t, err, "field a: value is required")
+
+	transform, err := New(Config{}, "", clock.Real)
+	require.NoError(t, err)
+	_, err = transform.Process(context.Background(), []byte(`[1]`))
+	assert.EqualError(t, err, "message is not an object")
+}
@@ -0,0 +1,225 @@
+// Package ratelimit limits the rate at which messages are handed to adapters.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/blockdaemon/chain_sink/pkg/logger"
+	"github.com/blockdaemon/chain_sink/pkg/stream"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+type Config struct {
+	// MessagesPerSecond and BytesPerSecond are unlimited if 0.
+	MessagesPerSecond float64        `mapstructure:"messages_per_second" validate:"gte=0"`
+	BytesPerSecond    float64        `mapstructure:"bytes_per_second" validate:"gte=0"`
+	Adaptive          AdaptiveConfig `mapstructure:"adaptive"`
+}
+
+// AdaptiveConfig lowers the rate when the adapter slows down or fails, and raises it back once it recovers.
+type AdaptiveConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// TargetLatency is the average delivery latency above which the rate is lowered.
+	TargetLatency time.Duration `mapstructure:"target_latency" default:"1s"`
+	// MaxErrorRate is the fraction of failed deliveries above which the rate is lowered.
+	MaxErrorRate float64 `mapstructure:"max_error_rate" default:"0.01" validate:"gte=0,lte=1"`
+	// MinFraction is the lowest fraction of the configured rate the rate is lowered to.
+	MinFraction float64       `mapstructure:"min_fraction" default:"0.1" validate:"gt=0,lte=1"`
+	Interval    time.Duration `mapstructure:"interval" default:"5s" validate:"gt=0"`
+}
+
+func (c Config) Enabled() bool {
+	return c.MessagesPerSecond > 0 || c.BytesPerSecond > 0
+}
+
+// Validate checks that the adaptive mode has a rate to adjust.
+func (c Config) Validate() error {
+	if c.Adaptive.Enabled && !c.Enabled() {
+		return fmt.Errorf("adaptive rate limiting requires messages_per_second or bytes_per_second")
+	}
+	return nil
+}
+
+// RateLimiter is a token bucket for messages and one for bytes. A RateLimiter can be shared by multiple adapters.
+type RateLimiter struct {
+	name     string
+	cfg      Config
+	messages *rate.Limiter
+	bytes    *rate.Limiter
+
+	mu sync.Mutex
+	// fraction of the configured rate that is currently allowed, lowered and raised by the adaptive mode.
+	fraction     float64
+	windowStart  time.Time
+	deliveries   int
+	failures     int
+	totalLatency time.Duration
+}
+
+// New creates a rate limiter, name identifies it in logs.
+func New(name string, cfg Config) *RateLimiter {
+	return &RateLimiter{
+		name:        name,
+		cfg:         cfg,
+		messages:    newLimiter(cfg.MessagesPerSecond),
+		bytes:       newLimiter(cfg.BytesPerSecond),
+		fraction:    1,
+		windowStart: time.Now(),
+	}
+}
+
+// newLimiter creates a limiter that allows a burst of one second worth of tokens.
+func newLimiter(perSecond float64) *rate.Limiter {
+	if perSecond <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), int(math.Max(1, math.Ceil(perSecond))))
+}
+
+// wait blocks until the message of size bytes is allowed. Messages larger than the byte burst take the whole burst.
+func (r *RateLimiter) wait(ctx context.Context, size int) error {
+	if err := r.messages.Wait(ctx); err != nil {
+		return err
+	}
+	if r.bytes.Limit() == rate.Inf {
+		return nil
+	}
+	return r.bytes.WaitN(ctx, min(size, r.bytes.Burst()))
+}
+
+// observe records a delivery for the adaptive mode and adjusts the rate once per interval.
+func (r *RateLimiter) observe(latency time.Duration, err error) {
+	if !r.cfg.Adaptive.Enabled {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.deliveries++
+	r.totalLatency += latency
+	if err != nil {
+		r.failures++
+	}
+
+	now := time.Now()
+	if now.Sub(r.windowStart) < r.cfg.Adaptive.Interval {
+		return
+	}
+
+	averageLatency := r.totalLatency / time.Duration(r.deliveries)
+	errorRate := float64(r.failures) / float64(r.deliveries)
+	previous := r.fraction
+	if averageLatency > r.cfg.Adaptive.TargetLatency || errorRate > r.cfg.Adaptive.MaxErrorRate {
+		// Multiplicative decrease and additive increase, like TCP congestion control.
+		r.fraction = math.Max(r.cfg.Adaptive.MinFraction, r.fraction/2)
+	} else {
+		r.fraction = math.Min(1, r.fraction+0.1)
+	}
+
+	if r.fraction != previous {
+		r.setFraction(r.fraction)
+		logger.Log.Info("adjusted adapter rate limit", zap.String("rate_limiter", r.name), zap.Float64("fraction", r.fraction),
+			zap.Duration("average_latency", averageLatency), zap.Float64("error_rate", errorRate))
+	}
+
+	r.windowStart = now
+	r.deliveries, r.failures, r.totalLatency = 0, 0, 0
+}
+
+func (r *RateLimiter) setFraction(fraction float64) {
+	if r.cfg.MessagesPerSecond > 0 {
+		r.messages.SetLimit(rate.Limit(r.cfg.MessagesPerSecond * fraction))
+	}
+	if r.cfg.BytesPerSecond > 0 {
+		r.bytes.SetLimit(rate.Limit(r.cfg.BytesPerSecond * fraction))
+	}
+}
+
+var _ stream.AsyncAdapter = (*Adapter)(nil)
+var _ stream.Lifecycle = (*Adapter)(nil)
+
+// Adapter waits for every rate limiter before handing a message to the next adapter. If the next adapter implements
+// stream.Lifecycle it is started, flushed and closed with the Adapter.
+type Adapter struct {
+	next     stream.Adapter
+	limiters []*RateLimiter
+}
+
+func Wrap(next stream.Adapter, limiters ...*RateLimiter) *Adapter {
+	return &Adapter{next: next, limiters: limiters}
+}
+
+func (a *Adapter) wait(ctx context.Context, message []byte) error {
+	for _, limiter := range a.limiters {
+		if err := limiter.wait(ctx, len(message)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Adapter) observe(start time.Time, err error) {
+	latency := time.Since(start)
+	for _, limiter := range a.limiters {
+		limiter.observe(latency, err)
+	}
+}
+
+func (a *Adapter) HandleMessage(ctx context.Context, message []byte) error {
+	if err := a.wait(ctx, message); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	err := a.next.HandleMessage(ctx, message)
+	a.observe(start, err)
+	return err
+}
+
+func (a *Adapter) HandleMessageAsync(ctx context.Context, message []byte, done func(error)) error {
+	asyncAdapter, ok := a.next.(stream.AsyncAdapter)
+	if !ok {
+		err := a.HandleMessage(ctx, message)
+		if err == nil {
+			done(nil)
+		}
+		return err
+	}
+
+	if err := a.wait(ctx, message); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	return asyncAdapter.HandleMessageAsync(ctx, message, func(err error) {
+		a.observe(start, err)
+		done(err)
+	})
+}
+
+func (a *Adapter) Start(ctx context.Context) error {
+	if lifecycle, ok := a.next.(stream.Lifecycle); ok {
+		return lifecycle.Start(ctx)
+	}
+	return nil
+}
+
+func (a *Adapter) Flush(ctx context.Context) error {
+	if lifecycle, ok := a.next.(stream.Lifecycle); ok {
+		return lifecycle.Flush(ctx)
+	}
+	return nil
+}
+
+func (a *Adapter) Close(ctx context.Context) error {
+	if lifecycle, ok := a.next.(stream.Lifecycle); ok {
+		return lifecycle.Close(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+type countingAdapter struct {
+	messages int
+	err      error
+}
+
+func (a *countingAdapter) HandleMessage(context.Context, []byte) error {
+	a.messages++
+	return a.err
+}
+
+func TestAdapter_rateLimit(t *testing.T) {
+	next := &countingAdapter{}
+	global := New("global", Config{MessagesPerSecond: 1000})
+	own := New("adapter", Config{BytesPerSecond: 100})
+	adapter := Wrap(next, global, own)
+
+	start := time.Now()
+	// the first 100 bytes are the burst, the next 50 bytes take half a second.
+	for range 15 {
+		require.NoError(t, adapter.HandleMessage(context.Background(), []byte("0123456789")))
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	assert.Equal(t, 15, next.messages)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, adapter.HandleMessageAsync(ctx, []byte("0123456789"), func(error) {
+		t.Fatal("done must not be called")
+	}))
+}
+
+func TestRateLimiter_adaptive(t *testing.T) {
+	limiter := New("adapter", Config{MessagesPerSecond: 100, Adaptive: AdaptiveConfig{
+		Enabled:       true,
+		TargetLatency: 100 * time.Millisecond,
+		MaxErrorRate:  0.1,
+		MinFraction:   0.2,
+		Interval:      time.Nanosecond,
+	}})
+
+	limiter.observe(time.Second, nil)
+	assert.Equal(t, rate.Limit(50), limiter.messages.Limit(), "slow deliveries halve the rate")
+
+	limiter.observe(time.Millisecond, errors.New("failed"))
+	limiter.observe(time.Millisecond, errors.New("failed"))
+	assert.Equal(t, rate.Limit(20), limiter.messages.Limit(), "the rate is not lowered below the min fraction")
+
+	limiter.observe(time.Millisecond, nil)
+	assert.InDelta(t, 30, float64(limiter.messages.Limit()), 0.001, "healthy deliveries raise the rate")
+}
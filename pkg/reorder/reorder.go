@@ -0,0 +1,265 @@
+// Package reorder buffers chain events and releases them sorted by their position in the chain.
+package reorder
+
+import (
+	"container/heap"
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blockdaemon/chain_sink/pkg/clock"
+	"github.com/blockdaemon/chain_sink/pkg/logger"
+	"github.com/blockdaemon/chain_sink/pkg/stream"
+	"github.com/valyala/fastjson"
+	"go.uber.org/zap"
+)
+
+type Config struct {
+	// The paths are dot separated, the values may be numbers or decimal or hex encoded strings.
+	BlockNumberPath      string `mapstructure:"block_number_path" default:"block_number"`
+	TransactionIndexPath string `mapstructure:"transaction_index_path" default:"transaction_index"`
+	LogIndexPath         string `mapstructure:"log_index_path" default:"log_index"`
+	// Window is the maximum time an event is buffered.
+	Window time.Duration `mapstructure:"window" default:"5s" validate:"gt=0"`
+	// Lag is the number of blocks after which a block is considered complete, events of a block are released once an
+	// event of a block Lag blocks later is received.
+	Lag uint64 `mapstructure:"lag" default:"1"`
+}
+
+var _ stream.AsyncAdapter = (*Reorderer)(nil)
+var _ stream.Lifecycle = (*Reorderer)(nil)
+
+// Reorderer is an adapter that buffers events and hands them to the next adapter sorted by block number, transaction
+// index and log index. Events are released when the watermark, the highest block number seen minus Lag, passes their
+// block, or once they were buffered for Window. Events that arrive after a later event was released, and events
+// without a block number, are handed on immediately. The next adapter's lifecycle is not managed by the Reorderer.
+type Reorderer struct {
+	cfg     Config
+	next    stream.Adapter
+	paths   [3][]string
+	mu      sync.Mutex
+	pending events
+	// sequence keeps the order of events with the same position.
+	sequence uint64
+	maxBlock uint64
+	seen     bool
+	released position
+	clock    clock.Clock
+}
+
+type position struct {
+	block, transaction, log uint64
+}
+
+func (p position) less(other position) bool {
+	if p.block != other.block {
+		return p.block < other.block
+	}
+	if p.transaction != other.transaction {
+		return p.transaction < other.transaction
+	}
+	return p.log < other.log
+}
+
+type event struct {
+	position position
+	sequence uint64
+	received time.Time
+	message  []byte
+	done     func(error)
+}
+
+// events is a min heap of events by position.
+type events []*event
+
+// before reports whether a is released before b.
+func (a *event) before(b *event) bool {
+	if a.position == b.position {
+		return a.sequence < b.sequence
+	}
+	return a.position.less(b.position)
+}
+
+func (e events) Len() int           { return len(e) }
+func (e events) Less(i, j int) bool { return e[i].before(e[j]) }
+func (e events) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e *events) Push(x any)        { *e = append(*e, x.(*event)) }
+func (e *events) Pop() any {
+	old := *e
+	last := old[len(old)-1]
+	*e = old[:len(old)-1]
+	return last
+}
+
+// New creates a reorderer that hands the events to next, the time events are buffered is measured with clk.
+func New(cfg Config, next stream.Adapter, clk clock.Clock) *Reorderer {
+	return &Reorderer{
+		cfg:  cfg,
+		next: next,
+		paths: [3][]string{
+			strings.Split(cfg.BlockNumberPath, "."),
+			strings.Split(cfg.TransactionIndexPath, "."),
+			strings.Split(cfg.LogIndexPath, "."),
+		},
+		clock: clk,
+	}
+}
+
+var parserPool = fastjson.ParserPool{}
+
+// position returns the position of the event, ok is false if the event has no block number. Missing transaction and
+// log indexes are 0.
+func (r *Reorderer) position(message []byte) (p position, ok bool) {
+	parser := parserPool.Get()
+	defer parserPool.Put(parser)
+
+	parsed, err := parser.ParseBytes(message)
+	if err != nil {
+		return p, false
+	}
+
+	var values [3]uint64
+	for i, path := range r.paths {
+		value, found := parseUint(parsed.Get(path...))
+		if i == 0 && !found {
+			return p, false
+		}
+		values[i] = value
+	}
+	return position{block: values[0], transaction: values[1], log: values[2]}, true
+}
+
+func parseUint(v *fastjson.Value) (uint64, bool) {
+	if v == nil {
+		return 0, false
+	}
+	switch v.Type() {
+	case fastjson.TypeNumber:
+		n, err := v.Uint64()
+		return n, err == nil
+	case fastjson.TypeString:
+		// Numbers are sent as decimal or as 0x prefixed hex strings.
+		s := string(v.GetStringBytes())
+		base := 10
+		if len(s) > 2 && (s[:2] == "0x" || s[:2] == "0X") {
+			s, base = s[2:], 16
+		}
+		n, err := strconv.ParseUint(s, base, 64)
+		return n, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func (r *Reorderer) HandleMessage(ctx context.Context, message []byte) error {
+	result := make(chan error, 1)
+	if err := r.HandleMessageAsync(ctx, message, func(err error) { result <- err }); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// HandleMessageAsync buffers the event and releases the events that passed the watermark.
+func (r *Reorderer) HandleMessageAsync(ctx context.Context, message []byte, done func(error)) error {
+	p, ok := r.position(message)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !ok || (r.seen && p.less(r.released)) {
+		if ok {
+			logger.Log.Debug("event arrived after a later event was released", zap.Uint64("block_number", p.block))
+		}
+		r.forward(ctx, &event{message: message, done: done})
+		return nil
+	}
+
+	r.sequence++
+	heap.Push(&r.pending, &event{position: p, sequence: r.sequence, received: r.clock.Now(), message: message, done: done})
+	r.maxBlock = max(r.maxBlock, p.block)
+
+	if r.maxBlock >= r.cfg.Lag {
+		watermark := r.maxBlock - r.cfg.Lag
+		r.releaseWhile(ctx, func(e *event) bool {
+			return e.position.block <= watermark
+		})
+	}
+	return nil
+}
+
+// releaseWhile forwards the buffered events in order while release returns true, the caller must hold the lock.
+func (r *Reorderer) releaseWhile(ctx context.Context, release func(e *event) bool) {
+	for r.pending.Len() > 0 && release(r.pending[0]) {
+		e := heap.Pop(&r.pending).(*event)
+		r.released = e.position
+		r.seen = true
+		r.forward(ctx, e)
+	}
+}
+
+// releaseExpired forwards the events that were buffered for longer than the window, and the events before them.
+func (r *Reorderer) releaseExpired(ctx context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	deadline := r.clock.Now().Add(-r.cfg.Window)
+	var last *event
+	for _, e := range r.pending {
+		if !e.received.After(deadline) && (last == nil || last.before(e)) {
+			last = e
+		}
+	}
+	if last == nil {
+		return
+	}
+
+	r.releaseWhile(ctx, func(e *event) bool {
+		return e == last || e.before(last)
+	})
+}
+
+func (r *Reorderer) forward(ctx context.Context, e *event) {
+	if asyncAdapter, ok := r.next.(stream.AsyncAdapter); ok {
+		if err := asyncAdapter.HandleMessageAsync(ctx, e.message, e.done); err != nil {
+			e.done(err)
+		}
+		return
+	}
+	e.done(r.next.HandleMessage(ctx, e.message))
+}
+
+// Start releases expired events until ctx is cancelled.
+func (r *Reorderer) Start(ctx context.Context) error {
+	ticker := time.NewTicker(max(r.cfg.Window/10, 10*time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			r.releaseExpired(ctx)
+		}
+	}
+}
+
+// Flush releases all buffered events.
+func (r *Reorderer) Flush(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.releaseWhile(ctx, func(*event) bool { return true })
+	return nil
+}
+
+func (r *Reorderer) Close(context.Context) error {
+	return nil
+}
@@ -0,0 +1,123 @@
+package reorder
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/blockdaemon/chain_sink/pkg/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fastjson"
+)
+
+type recordingAdapter struct {
+	messages []string
+}
+
+func (a *recordingAdapter) HandleMessage(_ context.Context, message []byte) error {
+	a.messages = append(a.messages, string(message))
+	return nil
+}
+
+func testEvent(block any, tx, log int) string {
+	blockJSON := fmt.Sprint(block)
+	if s, ok := block.(string); ok {
+		blockJSON = `"` + s + `"`
+	}
+	return fmt.Sprintf(`{"block":{"number":%s},"transaction_index":%d,"log_index":%d}`, blockJSON, tx, log)
+}
+
+func newTestReorderer(next *recordingAdapter, testClock *clock.Fake, lag uint64) *Reorderer {
+	return New(Config{
+		BlockNumberPath:      "block.number",
+		TransactionIndexPath: "transaction_index",
+		LogIndexPath:         "log_index",
+		Window:               time.Second,
+		Lag:                  lag,
+	}, next, testClock)
+}
+
+func handle(t *testing.T, r *Reorderer, message string, completed *int) {
+	require.NoError(t, r.HandleMessageAsync(context.Background(), []byte(message), func(err error) {
+		assert.NoError(t, err)
+		*completed++
+	}))
+}
+
+func TestReorderer_watermark(t *testing.T) {
+	next := &recordingAdapter{}
+	r := newTestReorderer(next, clock.NewFake(time.Now()), 2)
+
+	completed := 0
+	handle(t, r, testEvent(10, 1, 0), &completed)
+	handle(t, r, testEvent("10", 0, 1), &completed)
+	handle(t, r, testEvent("0xa", 0, 0), &completed)
+	handle(t, r, testEvent(11, 0, 0), &completed)
+	assert.Empty(t, next.messages, "block 10 is released once block 12 is received")
+
+	handle(t, r, testEvent(13, 0, 0), &completed)
+	assert.Equal(t, []string{testEvent("0xa", 0, 0), testEvent("10", 0, 1), testEvent(10, 1, 0), testEvent(11, 0, 0)}, next.messages)
+	assert.Equal(t, 4, completed)
+
+	handle(t, r, testEvent(9, 0, 0), &completed)
+	handle(t, r, `{"other":1}`, &completed)
+	assert.Equal(t, testEvent(9, 0, 0), next.messages[4], "late events are forwarded immediately")
+	assert.Equal(t, `{"other":1}`, next.messages[5], "events without block number are forwarded immediately")
+
+	require.NoError(t, r.Flush(context.Background()))
+	assert.Equal(t, testEvent(13, 0, 0), next.messages[6])
+	assert.Equal(t, 7, completed)
+}
+
+func TestParseUint(t *testing.T) {
+	tests := []struct {
+		json     string
+		expected uint64
+		ok       bool
+	}{
+		{json: `12`, expected: 12, ok: true},
+		{json: `"12"`, expected: 12, ok: true},
+		{json: `"010"`, expected: 10, ok: true},
+		{json: `"0x1f"`, expected: 31, ok: true},
+		{json: `"0X1F"`, expected: 31, ok: true},
+		{json: `"1_000"`},
+		{json: `"0b11"`},
+		{json: `"0x"`},
+		{json: `-1`},
+		{json: `null`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.json, func(t *testing.T) {
+			n, ok := parseUint(fastjson.MustParse(test.json))
+			assert.Equal(t, test.ok, ok)
+			assert.Equal(t, test.expected, n)
+		})
+	}
+}
+
+func TestReorderer_window(t *testing.T) {
+	testClock := clock.NewFake(time.Now())
+	next := &recordingAdapter{}
+	r := newTestReorderer(next, testClock, 10)
+
+	completed := 0
+	handle(t, r, testEvent(20, 0, 0), &completed)
+	testClock.Advance(500 * time.Millisecond)
+	handle(t, r, testEvent(21, 0, 0), &completed)
+	handle(t, r, testEvent(19, 0, 0), &completed)
+
+	r.releaseExpired(context.Background())
+	assert.Empty(t, next.messages)
+
+	testClock.Advance(600 * time.Millisecond)
+	r.releaseExpired(context.Background())
+	assert.Equal(t, []string{testEvent(19, 0, 0), testEvent(20, 0, 0)}, next.messages, "the expired event and the events before it are released")
+
+	testClock.Advance(time.Second)
+	r.releaseExpired(context.Background())
+	assert.Equal(t, testEvent(21, 0, 0), next.messages[2])
+	assert.Equal(t, 3, completed)
+}
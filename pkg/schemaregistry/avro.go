@@ -0,0 +1,365 @@
+package schemaregistry
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fastjson"
+)
+
+// avroSchema is a parsed avro schema. The encoder converts JSON messages into the avro binary encoding guided by the
+// schema, so JSON numbers are encoded as the numeric type declared in the schema.
+// See for reference: https://avro.apache.org/docs/1.11.1/specification/
+type avroSchema struct {
+	typ string
+
+	// named types
+	name string
+
+	fields  []avroField   // record
+	symbols []string      // enum
+	items   *avroSchema   // array
+	values  *avroSchema   // map
+	size    int           // fixed
+	union   []*avroSchema // union
+}
+
+type avroField struct {
+	name   string
+	schema *avroSchema
+	// default value of the field, nil when the field has no default.
+	defaultValue *fastjson.Value
+}
+
+type avroParser struct {
+	named map[string]*avroSchema
+}
+
+func parseAvroSchema(schema string) (*avroSchema, error) {
+	var raw any
+	if err := json.Unmarshal([]byte(schema), &raw); err != nil {
+		return nil, fmt.Errorf("error parsing avro schema: %w", err)
+	}
+
+	p := &avroParser{named: make(map[string]*avroSchema)}
+	return p.parse(raw, "")
+}
+
+func (p *avroParser) parse(raw any, namespace string) (*avroSchema, error) {
+	switch v := raw.(type) {
+	case string:
+		return p.parseName(v, namespace)
+	case []any:
+		union := &avroSchema{typ: "union"}
+		for _, branch := range v {
+			schema, err := p.parse(branch, namespace)
+			if err != nil {
+				return nil, err
+			}
+			union.union = append(union.union, schema)
+		}
+		return union, nil
+	case map[string]any:
+		return p.parseComplex(v, namespace)
+	}
+	return nil, fmt.Errorf("invalid avro schema: %v", raw)
+}
+
+func (p *avroParser) parseName(name, namespace string) (*avroSchema, error) {
+	switch name {
+	case "null", "boolean", "int", "long", "float", "double", "bytes", "string":
+		return &avroSchema{typ: name}, nil
+	}
+
+	if schema, ok := p.named[fullName(name, namespace)]; ok {
+		return schema, nil
+	}
+	if schema, ok := p.named[name]; ok {
+		return schema, nil
+	}
+	return nil, fmt.Errorf("unknown avro type %q", name)
+}
+
+func (p *avroParser) parseComplex(raw map[string]any, namespace string) (*avroSchema, error) {
+	typ, ok := raw["type"]
+	if !ok {
+		return nil, fmt.Errorf("avro schema is missing type: %v", raw)
+	}
+
+	typeName, ok := typ.(string)
+	if !ok {
+		// nested type definition, e.g. {"type": {"type": "array", ...}}
+		return p.parse(typ, namespace)
+	}
+
+	switch typeName {
+	case "record", "error", "enum", "fixed":
+	case "array":
+		items, err := p.parse(raw["items"], namespace)
+		if err != nil {
+			return nil, err
+		}
+		return &avroSchema{typ: "array", items: items}, nil
+	case "map":
+		values, err := p.parse(raw["values"], namespace)
+		if err != nil {
+			return nil, err
+		}
+		return &avroSchema{typ: "map", values: values}, nil
+	default:
+		// primitive types with attributes, such as logical types.
+		return p.parseName(typeName, namespace)
+	}
+
+	name, _ := raw["name"].(string)
+	if name == "" {
+		return nil, fmt.Errorf("avro %s is missing a name", typeName)
+	}
+	if ns, ok := raw["namespace"].(string); ok && !strings.Contains(name, ".") {
+		namespace = ns
+	}
+	name = fullName(name, namespace)
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		namespace = name[:i]
+	}
+
+	schema := &avroSchema{typ: typeName, name: name}
+	// registered before parsing fields to support recursive types.
+	p.named[name] = schema
+
+	switch typeName {
+	case "record", "error":
+		schema.typ = "record"
+		fields, _ := raw["fields"].([]any)
+		for _, rawField := range fields {
+			fieldMap, ok := rawField.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("invalid field in avro record %s", name)
+			}
+			fieldName, _ := fieldMap["name"].(string)
+			fieldSchema, err := p.parse(fieldMap["type"], namespace)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing field %s.%s: %w", name, fieldName, err)
+			}
+			field := avroField{name: fieldName, schema: fieldSchema}
+			if def, ok := fieldMap["default"]; ok {
+				encoded, err := json.Marshal(def)
+				if err != nil {
+					return nil, err
+				}
+				field.defaultValue = fastjson.MustParseBytes(encoded)
+			}
+			schema.fields = append(schema.fields, field)
+		}
+	case "enum":
+		symbols, _ := raw["symbols"].([]any)
+		for _, symbol := range symbols {
+			s, _ := symbol.(string)
+			schema.symbols = append(schema.symbols, s)
+		}
+	case "fixed":
+		size, _ := raw["size"].(float64)
+		schema.size = int(size)
+	}
+
+	return schema, nil
+}
+
+func fullName(name, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// encode appends the avro binary encoding of value to dst. A nil value is treated as JSON null.
+func (s *avroSchema) encode(dst []byte, value *fastjson.Value, path string) ([]byte, error) {
+	if value == nil {
+		value = nullValue
+	}
+
+	switch s.typ {
+	case "null":
+		if value.Type() != fastjson.TypeNull {
+			return nil, avroTypeError(path, s.typ, value)
+		}
+		return dst, nil
+	case "boolean":
+		switch value.Type() {
+		case fastjson.TypeTrue:
+			return append(dst, 1), nil
+		case fastjson.TypeFalse:
+			return append(dst, 0), nil
+		}
+		return nil, avroTypeError(path, s.typ, value)
+	case "int", "long":
+		n, err := avroInteger(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if s.typ == "int" && (n < math.MinInt32 || n > math.MaxInt32) {
+			return nil, fmt.Errorf("%s: value %d overflows avro int", path, n)
+		}
+		return binary.AppendVarint(dst, n), nil
+	case "float", "double":
+		f, err := avroFloat(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if s.typ == "float" {
+			return binary.LittleEndian.AppendUint32(dst, math.Float32bits(float32(f))), nil
+		}
+		return binary.LittleEndian.AppendUint64(dst, math.Float64bits(f)), nil
+	case "string", "bytes":
+		b, err := value.StringBytes()
+		if err != nil {
+			return nil, avroTypeError(path, s.typ, value)
+		}
+		dst = binary.AppendVarint(dst, int64(len(b)))
+		return append(dst, b...), nil
+	case "fixed":
+		b, err := value.StringBytes()
+		if err != nil || len(b) != s.size {
+			return nil, fmt.Errorf("%s: expected fixed %s of size %d", path, s.name, s.size)
+		}
+		return append(dst, b...), nil
+	case "enum":
+		b, err := value.StringBytes()
+		if err != nil {
+			return nil, avroTypeError(path, s.typ, value)
+		}
+		for i, symbol := range s.symbols {
+			if symbol == string(b) {
+				return binary.AppendVarint(dst, int64(i)), nil
+			}
+		}
+		return nil, fmt.Errorf("%s: %q is not a symbol of enum %s", path, string(b), s.name)
+	case "array":
+		items, err := value.Array()
+		if err != nil {
+			return nil, avroTypeError(path, s.typ, value)
+		}
+		if len(items) > 0 {
+			dst = binary.AppendVarint(dst, int64(len(items)))
+			for i, item := range items {
+				if dst, err = s.items.encode(dst, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return append(dst, 0), nil
+	case "map":
+		object, err := value.Object()
+		if err != nil {
+			return nil, avroTypeError(path, s.typ, value)
+		}
+		if object.Len() > 0 {
+			dst = binary.AppendVarint(dst, int64(object.Len()))
+			object.Visit(func(key []byte, v *fastjson.Value) {
+				if err != nil {
+					return
+				}
+				dst = binary.AppendVarint(dst, int64(len(key)))
+				dst = append(dst, key...)
+				dst, err = s.values.encode(dst, v, path+"."+string(key))
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		return append(dst, 0), nil
+	case "record":
+		if value.Type() != fastjson.TypeObject {
+			return nil, avroTypeError(path, s.name, value)
+		}
+		for _, field := range s.fields {
+			fieldValue := value.Get(field.name)
+			if fieldValue == nil {
+				fieldValue = field.defaultValue
+			}
+			var err error
+			if dst, err = field.schema.encode(dst, fieldValue, path+"."+field.name); err != nil {
+				return nil, err
+			}
+		}
+		return dst, nil
+	case "union":
+		for i, branch := range s.union {
+			if branch.matches(value) {
+				dst = binary.AppendVarint(dst, int64(i))
+				return branch.encode(dst, value, path)
+			}
+		}
+		return nil, fmt.Errorf("%s: no union branch matches %s", path, value.Type())
+	}
+
+	return nil, fmt.Errorf("%s: unsupported avro type %s", path, s.typ)
+}
+
+// matches reports whether the JSON value can be encoded using the schema, it is used to select union branches.
+func (s *avroSchema) matches(value *fastjson.Value) bool {
+	switch value.Type() {
+	case fastjson.TypeNull:
+		return s.typ == "null"
+	case fastjson.TypeTrue, fastjson.TypeFalse:
+		return s.typ == "boolean"
+	case fastjson.TypeNumber:
+		switch s.typ {
+		case "int", "long":
+			_, err := avroInteger(value)
+			return err == nil
+		case "float", "double":
+			return true
+		}
+	case fastjson.TypeString:
+		switch s.typ {
+		case "string", "bytes":
+			return true
+		case "int", "long":
+			_, err := avroInteger(value)
+			return err == nil
+		case "float", "double":
+			_, err := avroFloat(value)
+			return err == nil
+		case "enum", "fixed":
+			_, err := s.encode(nil, value, "")
+			return err == nil
+		}
+	case fastjson.TypeArray:
+		return s.typ == "array"
+	case fastjson.TypeObject:
+		return s.typ == "record" || s.typ == "map"
+	}
+	return false
+}
+
+var nullValue = fastjson.MustParse("null")
+
+func avroInteger(value *fastjson.Value) (int64, error) {
+	switch value.Type() {
+	case fastjson.TypeNumber:
+		return value.Int64()
+	case fastjson.TypeString:
+		// large integers are often sent as strings to prevent precision loss.
+		return strconv.ParseInt(string(value.GetStringBytes()), 10, 64)
+	}
+	return 0, fmt.Errorf("expected integer, got %s", value.Type())
+}
+
+func avroFloat(value *fastjson.Value) (float64, error) {
+	switch value.Type() {
+	case fastjson.TypeNumber:
+		return value.Float64()
+	case fastjson.TypeString:
+		return strconv.ParseFloat(string(value.GetStringBytes()), 64)
+	}
+	return 0, fmt.Errorf("expected number, got %s", value.Type())
+}
+
+func avroTypeError(path, expected string, value *fastjson.Value) error {
+	return fmt.Errorf("%s: expected %s, got %s", path, expected, value.Type())
+}
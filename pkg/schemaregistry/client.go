@@ -0,0 +1,118 @@
+// Package schemaregistry serializes Chain Watch messages into the Confluent Schema Registry wire format.
+package schemaregistry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const contentType = "application/vnd.schemaregistry.v1+json"
+
+type SchemaType string
+
+const (
+	SchemaTypeAvro     SchemaType = "AVRO"
+	SchemaTypeProtobuf SchemaType = "PROTOBUF"
+	SchemaTypeJSON     SchemaType = "JSON"
+)
+
+// Schema is a schema as stored in the schema registry.
+type Schema struct {
+	ID         int        `json:"id,omitempty"`
+	Version    int        `json:"version,omitempty"`
+	Subject    string     `json:"subject,omitempty"`
+	Schema     string     `json:"schema"`
+	SchemaType SchemaType `json:"schemaType,omitempty"`
+}
+
+// Client is a minimal client for the Confluent compatible Schema Registry REST API.
+type Client struct {
+	baseURL    string
+	username   string
+	password   string
+	httpClient *http.Client
+}
+
+func NewClient(baseURL, username, password string, timeout time.Duration) *Client {
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		username:   username,
+		password:   password,
+		httpClient: &http.Client{Timeout: timeout},
+	}
+}
+
+// Register registers the schema under the subject and returns the schema id. Registering a schema that already
+// exists returns the id of the existing schema.
+func (c *Client) Register(ctx context.Context, subject string, schema Schema) (int, error) {
+	body := Schema{Schema: schema.Schema}
+	// AVRO is the default schema type and is omitted for compatibility with older registries.
+	if schema.SchemaType != SchemaTypeAvro {
+		body.SchemaType = schema.SchemaType
+	}
+
+	var result Schema
+	if err := c.do(ctx, http.MethodPost, fmt.Sprintf("/subjects/%s/versions", url.PathEscape(subject)), body, &result); err != nil {
+		return 0, fmt.Errorf("error registering schema for subject %s: %w", subject, err)
+	}
+	return result.ID, nil
+}
+
+// Latest returns the latest schema version registered under the subject.
+func (c *Client) Latest(ctx context.Context, subject string) (Schema, error) {
+	var result Schema
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/subjects/%s/versions/latest", url.PathEscape(subject)), nil, &result); err != nil {
+		return result, fmt.Errorf("error retrieving latest schema for subject %s: %w", subject, err)
+	}
+	if result.SchemaType == "" {
+		result.SchemaType = SchemaTypeAvro
+	}
+	return result, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body any, result any) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", contentType)
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	return json.Unmarshal(respBody, result)
+}
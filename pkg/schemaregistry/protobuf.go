@@ -0,0 +1,94 @@
+package schemaregistry
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"slices"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// protobufEncoder converts JSON messages into protobuf using a message descriptor loaded from a descriptor set,
+// as generated by `protoc --include_imports --descriptor_set_out`.
+type protobufEncoder struct {
+	descriptor protoreflect.MessageDescriptor
+	// indexes is the encoded message index path of the message within its file, part of the wire format.
+	indexes []byte
+}
+
+var protojsonOptions = protojson.UnmarshalOptions{DiscardUnknown: true}
+
+func newProtobufEncoder(descriptorSetFile, messageName string) (*protobufEncoder, error) {
+	raw, err := os.ReadFile(descriptorSetFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading protobuf descriptor set: %w", err)
+	}
+
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(raw, &set); err != nil {
+		return nil, fmt.Errorf("error parsing protobuf descriptor set: %w", err)
+	}
+
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("error loading protobuf descriptor set: %w", err)
+	}
+
+	found, err := files.FindDescriptorByName(protoreflect.FullName(messageName))
+	if err != nil {
+		return nil, fmt.Errorf("error finding protobuf message %s: %w", messageName, err)
+	}
+
+	descriptor, ok := found.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a protobuf message", messageName)
+	}
+
+	return &protobufEncoder{
+		descriptor: descriptor,
+		indexes:    messageIndexes(descriptor),
+	}, nil
+}
+
+// messageIndexes encodes the path of the message within its file as zig-zag varints prefixed by the number of
+// indexes. The common case of the first message in the file is encoded as a single 0.
+func messageIndexes(descriptor protoreflect.MessageDescriptor) []byte {
+	var path []int64
+	var current protoreflect.Descriptor = descriptor
+	for {
+		message, ok := current.(protoreflect.MessageDescriptor)
+		if !ok {
+			break
+		}
+		path = append(path, int64(message.Index()))
+		current = message.Parent()
+	}
+	slices.Reverse(path)
+
+	if len(path) == 1 && path[0] == 0 {
+		return []byte{0}
+	}
+
+	indexes := binary.AppendVarint(nil, int64(len(path)))
+	for _, index := range path {
+		indexes = binary.AppendVarint(indexes, index)
+	}
+	return indexes
+}
+
+func (e *protobufEncoder) encode(dst []byte, message []byte) ([]byte, error) {
+	msg := dynamicpb.NewMessage(e.descriptor)
+	if err := protojsonOptions.Unmarshal(message, msg); err != nil {
+		return nil, fmt.Errorf("error converting message to protobuf: %w", err)
+	}
+
+	dst = append(dst, e.indexes...)
+	// Deterministic marshalling writes the fields in field number order, like generated messages.
+	return proto.MarshalOptions{Deterministic: true}.MarshalAppend(dst, msg)
+}
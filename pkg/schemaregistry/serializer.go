@@ -0,0 +1,171 @@
+package schemaregistry
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/blockdaemon/chain_sink/pkg/logger"
+	"github.com/valyala/fastjson"
+	"github.com/xeipuuv/gojsonschema"
+	"go.uber.org/zap"
+)
+
+// magicByte is the first byte of every message in the Confluent wire format, followed by the 4 byte schema id.
+const magicByte = 0
+
+type Format string
+
+const (
+	FormatNone       Format = "none"
+	FormatAvro       Format = "avro"
+	FormatProtobuf   Format = "protobuf"
+	FormatJSONSchema Format = "json_schema"
+)
+
+type Config struct {
+	Format   Format `mapstructure:"format" default:"none" validate:"oneof='' none avro protobuf json_schema"`
+	URL      string `mapstructure:"url" validate:"required_unless=Format none"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password" secret:"true"`
+	// Subject defaults to `<topic>-value`, following the topic name strategy.
+	Subject string `mapstructure:"subject"`
+	// SchemaFile is registered under the subject on startup, it is required unless UseLatestVersion is set.
+	SchemaFile string `mapstructure:"schema_file" validate:"excluded_with=UseLatestVersion"`
+	// UseLatestVersion uses the latest schema registered under the subject instead of registering the schema file. It
+	// can not be combined with SchemaFile, the messages are encoded with the registered schema its id refers to.
+	UseLatestVersion       bool          `mapstructure:"use_latest_version"`
+	ProtobufDescriptorFile string        `mapstructure:"protobuf_descriptor_file" validate:"required_if=Format protobuf"`
+	ProtobufMessage        string        `mapstructure:"protobuf_message" validate:"required_if=Format protobuf"`
+	Timeout                time.Duration `mapstructure:"timeout" default:"10s"`
+}
+
+func (c Config) Enabled() bool {
+	return c.Format != "" && c.Format != FormatNone
+}
+
+// Serializer converts a Chain Watch JSON message into the Confluent Schema Registry wire format.
+type Serializer interface {
+	Serialize(message []byte) ([]byte, error)
+}
+
+type serializer struct {
+	schemaId int
+	encode   func(dst []byte, message []byte) ([]byte, error)
+}
+
+// NewSerializer creates a serializer for the configured format. It registers the schema file, or looks up the latest
+// version of the subject, so it requires the schema registry to be reachable.
+func NewSerializer(ctx context.Context, cfg Config, topic string) (Serializer, error) {
+	subject := cfg.Subject
+	if subject == "" {
+		subject = topic + "-value"
+	}
+
+	schemaType := map[Format]SchemaType{
+		FormatAvro:       SchemaTypeAvro,
+		FormatProtobuf:   SchemaTypeProtobuf,
+		FormatJSONSchema: SchemaTypeJSON,
+	}[cfg.Format]
+	if schemaType == "" {
+		return nil, fmt.Errorf("unsupported serializer format: %s", cfg.Format)
+	}
+	if cfg.SchemaFile != "" && cfg.UseLatestVersion {
+		return nil, fmt.Errorf("schema_file can not be combined with use_latest_version")
+	}
+
+	var schemaText string
+	if cfg.SchemaFile != "" {
+		raw, err := os.ReadFile(cfg.SchemaFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading schema file: %w", err)
+		}
+		schemaText = string(raw)
+	}
+
+	client := NewClient(cfg.URL, cfg.Username, cfg.Password, cfg.Timeout)
+
+	var schemaId int
+	if cfg.UseLatestVersion {
+		latest, err := client.Latest(ctx, subject)
+		if err != nil {
+			return nil, err
+		}
+		if latest.SchemaType != schemaType {
+			return nil, fmt.Errorf("subject %s has schema type %s, expected %s", subject, latest.SchemaType, schemaType)
+		}
+		schemaId = latest.ID
+		schemaText = latest.Schema
+	} else {
+		if schemaText == "" {
+			return nil, fmt.Errorf("schema_file is required to register the schema")
+		}
+		var err error
+		schemaId, err = client.Register(ctx, subject, Schema{Schema: schemaText, SchemaType: schemaType})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	logger.Log.Info("using schema registry schema", zap.String("subject", subject), zap.Int("schema_id", schemaId), zap.String("format", string(cfg.Format)))
+
+	s := &serializer{schemaId: schemaId}
+	switch cfg.Format {
+	case FormatAvro:
+		schema, err := parseAvroSchema(schemaText)
+		if err != nil {
+			return nil, err
+		}
+		s.encode = func(dst []byte, message []byte) ([]byte, error) {
+			parser := parserPool.Get()
+			defer parserPool.Put(parser)
+
+			parsed, err := parser.ParseBytes(message)
+			if err != nil {
+				return nil, err
+			}
+			return schema.encode(dst, parsed, "$")
+		}
+	case FormatProtobuf:
+		encoder, err := newProtobufEncoder(cfg.ProtobufDescriptorFile, cfg.ProtobufMessage)
+		if err != nil {
+			return nil, err
+		}
+		s.encode = encoder.encode
+	case FormatJSONSchema:
+		schema, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(schemaText))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing json schema: %w", err)
+		}
+		// JSON schema messages are the JSON document itself, after it was validated against the schema.
+		s.encode = func(dst []byte, message []byte) ([]byte, error) {
+			result, err := schema.Validate(gojsonschema.NewBytesLoader(message))
+			if err != nil {
+				return nil, err
+			}
+			if !result.Valid() {
+				reasons := make([]string, 0, len(result.Errors()))
+				for _, resultErr := range result.Errors() {
+					reasons = append(reasons, resultErr.String())
+				}
+				return nil, fmt.Errorf("message does not match the json schema: %s", strings.Join(reasons, ", "))
+			}
+			return append(dst, message...), nil
+		}
+	}
+
+	return s, nil
+}
+
+var parserPool = fastjson.ParserPool{}
+
+func (s *serializer) Serialize(message []byte) ([]byte, error) {
+	dst := make([]byte, 5, len(message)+5)
+	dst[0] = magicByte
+	binary.BigEndian.PutUint32(dst[1:], uint32(s.schemaId))
+
+	return s.encode(dst, message)
+}
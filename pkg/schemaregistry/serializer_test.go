@@ -0,0 +1,189 @@
+package schemaregistry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fastjson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+const testAvroSchema = `{
+	"type": "record",
+	"name": "Event",
+	"namespace": "com.blockdaemon",
+	"fields": [
+		{"name": "id", "type": "string"},
+		{"name": "block", "type": "long"},
+		{"name": "amount", "type": ["null", "double"], "default": null},
+		{"name": "tags", "type": {"type": "array", "items": "string"}}
+	]
+}`
+
+// testRegistry is a stand-in for the schema registry that stores schemas in memory.
+type testRegistry struct {
+	schemas  map[string]Schema
+	requests []string
+}
+
+func newTestRegistry(t *testing.T) (*testRegistry, *httptest.Server) {
+	registry := &testRegistry{schemas: make(map[string]Schema)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /subjects/{subject}/versions", func(w http.ResponseWriter, r *http.Request) {
+		registry.requests = append(registry.requests, r.Method+" "+r.URL.Path)
+		assert.Equal(t, contentType, r.Header.Get("Content-Type"))
+
+		var schema Schema
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&schema))
+		schema.ID = len(registry.schemas) + 7
+		schema.Version = 1
+		schema.Subject = r.PathValue("subject")
+		registry.schemas[schema.Subject] = schema
+		_ = json.NewEncoder(w).Encode(map[string]int{"id": schema.ID})
+	})
+	mux.HandleFunc("GET /subjects/{subject}/versions/latest", func(w http.ResponseWriter, r *http.Request) {
+		registry.requests = append(registry.requests, r.Method+" "+r.URL.Path)
+		schema, ok := registry.schemas[r.PathValue("subject")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error_code":40401,"message":"Subject not found."}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(schema)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return registry, server
+}
+
+func writeFile(t *testing.T, name string, content []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, content, 0o600))
+	return path
+}
+
+func TestSerializer_avro(t *testing.T) {
+	registry, server := newTestRegistry(t)
+
+	serializer, err := NewSerializer(context.Background(), Config{
+		Format:     FormatAvro,
+		URL:        server.URL,
+		SchemaFile: writeFile(t, "event.avsc", []byte(testAvroSchema)),
+	}, "events")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"POST /subjects/events-value/versions"}, registry.requests)
+	assert.Empty(t, registry.schemas["events-value"].SchemaType)
+
+	encoded, err := serializer.Serialize([]byte(`{"id":"a","block":10,"tags":["x"],"ignored":true}`))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 0, 7, 2, 'a', 20, 0, 2, 2, 'x', 0}, encoded)
+
+	encoded, err = serializer.Serialize([]byte(`{"id":"a","block":"10","amount":1.5,"tags":[]}`))
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 0, 7, 2, 'a', 20, 2, 0, 0, 0, 0, 0, 0, 0xf8, 0x3f, 0}, encoded)
+
+	_, err = serializer.Serialize([]byte(`{"id":1,"block":10,"tags":[]}`))
+	assert.ErrorContains(t, err, "$.id: expected string, got number")
+}
+
+func TestAvroSchema_stringNumberInUnion(t *testing.T) {
+	schema, err := parseAvroSchema(`{
+		"type": "record",
+		"name": "Block",
+		"fields": [
+			{"name": "block", "type": ["null", "long"]},
+			{"name": "amount", "type": ["null", "double"]}
+		]
+	}`)
+	require.NoError(t, err)
+
+	encoded, err := schema.encode(nil, fastjson.MustParse(`{"block":"10","amount":"1.5"}`), "$")
+	require.NoError(t, err)
+	assert.Equal(t, []byte{2, 20, 2, 0, 0, 0, 0, 0, 0, 0xf8, 0x3f}, encoded)
+
+	_, err = schema.encode(nil, fastjson.MustParse(`{"block":"ten","amount":null}`), "$")
+	assert.ErrorContains(t, err, "no union branch matches")
+}
+
+func TestSerializer_jsonSchemaUseLatestVersion(t *testing.T) {
+	registry, server := newTestRegistry(t)
+	registry.schemas["custom"] = Schema{ID: 3, Version: 2, Subject: "custom", Schema: `{"type":"object","required":["id"]}`, SchemaType: SchemaTypeJSON}
+
+	serializer, err := NewSerializer(context.Background(), Config{
+		Format:           FormatJSONSchema,
+		URL:              server.URL,
+		Subject:          "custom",
+		UseLatestVersion: true,
+	}, "events")
+	require.NoError(t, err)
+
+	encoded, err := serializer.Serialize([]byte(`{"id":"a"}`))
+	require.NoError(t, err)
+	assert.Equal(t, append([]byte{0, 0, 0, 0, 3}, `{"id":"a"}`...), encoded)
+
+	_, err = serializer.Serialize([]byte(`{"block":1}`))
+	assert.ErrorContains(t, err, "message does not match the json schema: (root): id is required")
+
+	_, err = NewSerializer(context.Background(), Config{
+		Format:           FormatJSONSchema,
+		URL:              server.URL,
+		Subject:          "custom",
+		SchemaFile:       writeFile(t, "event.json", []byte(`{"type":"object"}`)),
+		UseLatestVersion: true,
+	}, "events")
+	assert.EqualError(t, err, "schema_file can not be combined with use_latest_version")
+
+	_, err = NewSerializer(context.Background(), Config{
+		Format:           FormatAvro,
+		URL:              server.URL,
+		Subject:          "custom",
+		UseLatestVersion: true,
+	}, "events")
+	assert.ErrorContains(t, err, "has schema type JSON, expected AVRO")
+}
+
+func TestSerializer_protobuf(t *testing.T) {
+	_, server := newTestRegistry(t)
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("event.proto"),
+		Package: proto.String("chainsink"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("Other")},
+			{
+				Name: proto.String("Event"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					{Name: proto.String("id"), JsonName: proto.String("id"), Number: proto.Int32(1), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()},
+					{Name: proto.String("block"), JsonName: proto.String("block"), Number: proto.Int32(2), Type: descriptorpb.FieldDescriptorProto_TYPE_UINT64.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()},
+				},
+			},
+		},
+	}
+	descriptorSet, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}})
+	require.NoError(t, err)
+
+	serializer, err := NewSerializer(context.Background(), Config{
+		Format:                 FormatProtobuf,
+		URL:                    server.URL,
+		SchemaFile:             writeFile(t, "event.proto", []byte(`syntax = "proto3"; package chainsink; message Other {} message Event { string id = 1; uint64 block = 2; }`)),
+		ProtobufDescriptorFile: writeFile(t, "event.pb", descriptorSet),
+		ProtobufMessage:        "chainsink.Event",
+	}, "events")
+	require.NoError(t, err)
+
+	encoded, err := serializer.Serialize([]byte(`{"id":"a","block":"10","unknown":1}`))
+	require.NoError(t, err)
+	// header, message indexes [1] and the protobuf encoded message.
+	assert.Equal(t, []byte{0, 0, 0, 0, 7, 2, 2, 0x0a, 1, 'a', 0x10, 10}, encoded)
+}
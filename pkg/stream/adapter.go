@@ -5,3 +5,30 @@ import "context"
 type Adapter interface {
 	HandleMessage(ctx context.Context, message []byte) error
 }
+
+// AsyncAdapter is an adapter that reports completion through a callback instead of blocking until the message is
+// delivered. This allows the stream to keep forwarding messages while deliveries are in flight, the acknowledgement
+// is sent to Chain Watch once done is called without an error.
+//
+// HandleMessageAsync returns an error if the message could not be accepted, in which case done must not be called.
+// Otherwise done must be called exactly once, it may be called from any goroutine.
+type AsyncAdapter interface {
+	Adapter
+	HandleMessageAsync(ctx context.Context, message []byte, done func(error)) error
+}
+
+// Lifecycle is implemented by adapters that run background work or buffer messages. Start is called before any
+// message is handled and runs until ctx is cancelled, an error returned by Start stops the application. On shutdown
+// the streams are stopped first, then Flush is called to deliver buffered messages, Start's context is cancelled
+// and finally Close is called.
+type Lifecycle interface {
+	Start(ctx context.Context) error
+	Flush(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+// BatchAdapter is implemented by adapters that deliver multiple messages at once. Use a Batcher to forward the
+// messages of a stream to a BatchAdapter.
+type BatchAdapter interface {
+	HandleBatch(ctx context.Context, messages [][]byte) error
+}
@@ -0,0 +1,245 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+type BatchConfig struct {
+	// MaxMessages should not exceed the stream's max_in_flight, otherwise batches are only sent after MaxLatency.
+	MaxMessages int           `mapstructure:"max_messages" default:"500" validate:"gte=1"`
+	MaxBytes    int           `mapstructure:"max_bytes" default:"1048576" validate:"gte=1"`
+	MaxLatency  time.Duration `mapstructure:"max_latency" default:"100ms" validate:"gt=0"`
+}
+
+var _ AsyncAdapter = (*Batcher)(nil)
+var _ Lifecycle = (*Batcher)(nil)
+
+// Batcher collects messages into batches that are handed to a BatchAdapter. A batch is sent once it holds
+// MaxMessages messages or MaxBytes bytes, or MaxLatency after its first message. Every message of a batch is
+// completed with the result of HandleBatch. Batches are handled one at a time, in order, by Start.
+type Batcher struct {
+	cfg     BatchConfig
+	adapter BatchAdapter
+
+	mu      sync.Mutex
+	current *batch
+	batches chan *batch
+	// stopped is closed when Start returns or the batcher is closed, batches can no longer be handled.
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+type batch struct {
+	messages [][]byte
+	dones    []func(error)
+	bytes    int
+	timer    *time.Timer
+	// handled is closed after the batch was handled.
+	handled chan struct{}
+}
+
+// NewBatcher creates a batcher for the adapter. If the adapter implements Lifecycle it is started, flushed and closed
+// with the batcher.
+func NewBatcher(cfg BatchConfig, adapter BatchAdapter) *Batcher {
+	return &Batcher{
+		cfg:     cfg,
+		adapter: adapter,
+		batches: make(chan *batch),
+		stopped: make(chan struct{}),
+	}
+}
+
+var errBatcherStopped = errors.New("batcher stopped")
+
+func (b *Batcher) HandleMessage(ctx context.Context, message []byte) error {
+	result := make(chan error, 1)
+	if err := b.HandleMessageAsync(ctx, message, func(err error) { result <- err }); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// HandleMessageAsync adds the message to the current batch, it blocks while a full batch waits to be handled.
+func (b *Batcher) HandleMessageAsync(ctx context.Context, message []byte, done func(error)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.current == nil {
+		current := &batch{handled: make(chan struct{})}
+		current.timer = time.AfterFunc(b.cfg.MaxLatency, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			// The batch waits until Start takes it, or fails once the batcher is stopped or closed.
+			if b.current == current {
+				b.send(context.Background())
+			}
+		})
+		b.current = current
+	}
+
+	b.current.messages = append(b.current.messages, message)
+	b.current.dones = append(b.current.dones, done)
+	b.current.bytes += len(message)
+
+	if len(b.current.messages) >= b.cfg.MaxMessages || b.current.bytes >= b.cfg.MaxBytes {
+		b.send(ctx)
+	}
+	return nil
+}
+
+// send hands the current batch to Start, the caller must hold the lock. Sending under the lock keeps the batches in
+// order and applies backpressure while a batch is handled. If the batch can not be sent its messages are completed
+// with the error.
+func (b *Batcher) send(ctx context.Context) {
+	current := b.current
+	b.current = nil
+	current.timer.Stop()
+
+	var err error
+	select {
+	case b.batches <- current:
+		return
+	case <-b.stopped:
+		err = errBatcherStopped
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	for _, done := range current.dones {
+		done(err)
+	}
+	close(current.handled)
+}
+
+// Start handles the batches until ctx is cancelled, it also starts the adapter if it implements Lifecycle.
+func (b *Batcher) Start(ctx context.Context) error {
+	group, gCtx := errgroup.WithContext(ctx)
+	if lifecycle, ok := b.adapter.(Lifecycle); ok {
+		group.Go(func() error {
+			return lifecycle.Start(gCtx)
+		})
+	}
+
+	group.Go(func() error {
+		defer b.stopOnce.Do(func() { close(b.stopped) })
+		for {
+			select {
+			case <-gCtx.Done():
+				return gCtx.Err()
+			case current := <-b.batches:
+				err := b.adapter.HandleBatch(gCtx, current.messages)
+				if err != nil {
+					err = fmt.Errorf("error handling batch of %d messages: %w", len(current.messages), err)
+				}
+				for _, done := range current.dones {
+					done(err)
+				}
+				close(current.handled)
+			}
+		}
+	})
+
+	return group.Wait()
+}
+
+// Flush sends the current batch and waits until it was handled, then flushes the adapter.
+func (b *Batcher) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	current := b.current
+	if current != nil {
+		b.send(ctx)
+	}
+	b.mu.Unlock()
+
+	if current != nil {
+		select {
+		case <-current.handled:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if lifecycle, ok := b.adapter.(Lifecycle); ok {
+		return lifecycle.Flush(ctx)
+	}
+	return nil
+}
+
+// Close fails the batches that are waiting to be handled and closes the adapter.
+func (b *Batcher) Close(ctx context.Context) error {
+	b.stopOnce.Do(func() { close(b.stopped) })
+	if lifecycle, ok := b.adapter.(Lifecycle); ok {
+		return lifecycle.Close(ctx)
+	}
+	return nil
+}
+
+// SingleMessageBatchAdapter is a BatchAdapter that hands the messages of a batch to an Adapter, so adapters that are
+// not batch aware can be batched. Messages are handed to an AsyncAdapter all at once, otherwise one by one.
+type SingleMessageBatchAdapter struct {
+	Adapter
+}
+
+func (a SingleMessageBatchAdapter) HandleBatch(ctx context.Context, messages [][]byte) error {
+	asyncAdapter, ok := a.Adapter.(AsyncAdapter)
+	if !ok {
+		for _, message := range messages {
+			if err := a.HandleMessage(ctx, message); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	results := make(chan error, len(messages))
+	accepted := 0
+	var err error
+	for _, message := range messages {
+		if err = asyncAdapter.HandleMessageAsync(ctx, message, func(err error) { results <- err }); err != nil {
+			break
+		}
+		accepted++
+	}
+
+	// All accepted messages are waited for, so none is completed after the batch.
+	for range accepted {
+		if result := <-results; err == nil {
+			err = result
+		}
+	}
+	return err
+}
+
+// Start, Flush and Close forward to the adapter if it implements Lifecycle.
+func (a SingleMessageBatchAdapter) Start(ctx context.Context) error {
+	if lifecycle, ok := a.Adapter.(Lifecycle); ok {
+		return lifecycle.Start(ctx)
+	}
+	return nil
+}
+
+func (a SingleMessageBatchAdapter) Flush(ctx context.Context) error {
+	if lifecycle, ok := a.Adapter.(Lifecycle); ok {
+		return lifecycle.Flush(ctx)
+	}
+	return nil
+}
+
+func (a SingleMessageBatchAdapter) Close(ctx context.Context) error {
+	if lifecycle, ok := a.Adapter.(Lifecycle); ok {
+		return lifecycle.Close(ctx)
+	}
+	return nil
+}
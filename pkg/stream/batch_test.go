@@ -0,0 +1,153 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingBatchAdapter struct {
+	sync.Mutex
+	batches [][]string
+	err     error
+}
+
+func (a *recordingBatchAdapter) HandleBatch(_ context.Context, messages [][]byte) error {
+	a.Lock()
+	defer a.Unlock()
+	batch := make([]string, 0, len(messages))
+	for _, message := range messages {
+		batch = append(batch, string(message))
+	}
+	a.batches = append(a.batches, batch)
+	return a.err
+}
+
+func (a *recordingBatchAdapter) recorded() [][]string {
+	a.Lock()
+	defer a.Unlock()
+	return a.batches
+}
+
+func startBatcher(t *testing.T, cfg BatchConfig, adapter BatchAdapter) *Batcher {
+	batcher := NewBatcher(cfg, adapter)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- batcher.Start(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		assert.ErrorIs(t, <-stopped, context.Canceled)
+	})
+	return batcher
+}
+
+// results collects the completions of the messages.
+type results struct {
+	sync.Mutex
+	errs []error
+}
+
+func (r *results) done(err error) {
+	r.Lock()
+	defer r.Unlock()
+	r.errs = append(r.errs, err)
+}
+
+func (r *results) count() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.errs)
+}
+
+func TestBatcher_maxMessagesAndBytes(t *testing.T) {
+	adapter := &recordingBatchAdapter{}
+	batcher := startBatcher(t, BatchConfig{MaxMessages: 2, MaxBytes: 5, MaxLatency: time.Hour}, adapter)
+
+	r := &results{}
+	for _, message := range []string{"a", "b", "cccccc", "d"} {
+		require.NoError(t, batcher.HandleMessageAsync(context.Background(), []byte(message), r.done))
+	}
+
+	assert.Eventually(t, func() bool { return r.count() == 3 }, time.Second, time.Millisecond)
+	assert.Equal(t, [][]string{{"a", "b"}, {"cccccc"}}, adapter.recorded())
+
+	require.NoError(t, batcher.Flush(context.Background()))
+	assert.Equal(t, [][]string{{"a", "b"}, {"cccccc"}, {"d"}}, adapter.recorded())
+	assert.Equal(t, []error{nil, nil, nil, nil}, r.errs)
+}
+
+func TestBatcher_maxLatency(t *testing.T) {
+	adapter := &recordingBatchAdapter{}
+	batcher := startBatcher(t, BatchConfig{MaxMessages: 100, MaxBytes: 1000, MaxLatency: 10 * time.Millisecond}, adapter)
+
+	require.NoError(t, batcher.HandleMessage(context.Background(), []byte("a")))
+	assert.Equal(t, [][]string{{"a"}}, adapter.recorded())
+}
+
+func TestBatcher_closeWithoutStart(t *testing.T) {
+	batcher := NewBatcher(BatchConfig{MaxMessages: 100, MaxBytes: 1000, MaxLatency: time.Millisecond}, &recordingBatchAdapter{})
+
+	r := &results{}
+	require.NoError(t, batcher.HandleMessageAsync(context.Background(), []byte("a"), r.done))
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, batcher.Close(context.Background()))
+
+	assert.Eventually(t, func() bool { return r.count() == 1 }, time.Second, time.Millisecond)
+	assert.ErrorIs(t, r.errs[0], errBatcherStopped)
+	require.NoError(t, batcher.HandleMessageAsync(context.Background(), []byte("b"), r.done), "the lock is released")
+}
+
+func TestBatcher_error(t *testing.T) {
+	adapter := &recordingBatchAdapter{err: errors.New("sink failed")}
+	batcher := startBatcher(t, BatchConfig{MaxMessages: 2, MaxBytes: 1000, MaxLatency: time.Hour}, adapter)
+
+	r := &results{}
+	require.NoError(t, batcher.HandleMessageAsync(context.Background(), []byte("a"), r.done))
+	require.NoError(t, batcher.HandleMessageAsync(context.Background(), []byte("b"), r.done))
+
+	assert.Eventually(t, func() bool { return r.count() == 2 }, time.Second, time.Millisecond)
+	for _, err := range r.errs {
+		assert.EqualError(t, err, "error handling batch of 2 messages: sink failed")
+	}
+}
+
+type asyncRecordingAdapter struct {
+	sync.Mutex
+	messages []string
+}
+
+func (a *asyncRecordingAdapter) HandleMessage(_ context.Context, message []byte) error {
+	return errors.New("not used")
+}
+
+func (a *asyncRecordingAdapter) HandleMessageAsync(_ context.Context, message []byte, done func(error)) error {
+	a.Lock()
+	a.messages = append(a.messages, string(message))
+	a.Unlock()
+	go done(nil)
+	return nil
+}
+
+func TestSingleMessageBatchAdapter(t *testing.T) {
+	syncAdapter := &recordingAdapter{}
+	require.NoError(t, SingleMessageBatchAdapter{syncAdapter}.HandleBatch(context.Background(), [][]byte{[]byte("a"), []byte("b")}))
+	assert.Equal(t, []string{"a", "b"}, syncAdapter.messages)
+
+	asyncAdapter := &asyncRecordingAdapter{}
+	require.NoError(t, SingleMessageBatchAdapter{asyncAdapter}.HandleBatch(context.Background(), [][]byte{[]byte("a"), []byte("b")}))
+	assert.Equal(t, []string{"a", "b"}, asyncAdapter.messages)
+}
+
+type recordingAdapter struct {
+	messages []string
+}
+
+func (a *recordingAdapter) HandleMessage(_ context.Context, message []byte) error {
+	a.messages = append(a.messages, string(message))
+	return nil
+}
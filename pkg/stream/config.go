@@ -1,8 +1,11 @@
 package stream
 
 import (
+	"net/http"
 	"regexp"
+	"time"
 
+	"github.com/blockdaemon/chain_sink/pkg/config"
 	"github.com/google/uuid"
 )
 
@@ -18,17 +21,117 @@ type Config struct {
 	URL            string     `mapstructure:"url" validate:"required"`
 	Headers        []Header   `mapstructure:"headers"`
 	WorkerPoolSize int        `mapstructure:"worker_pool_size" default:"1"`
-	ApiKey         string     `mapstructure:"api_key"`
+	ApiKey         string     `mapstructure:"api_key" secret:"true"`
+	// MaxInFlight limits the number of messages handed to an AsyncAdapter that are not completed yet.
+	MaxInFlight int `mapstructure:"max_in_flight" default:"1000" validate:"gte=0"`
+	// DrainTimeout limits the time to handle and acknowledge the messages that were already read when shutting down.
+	DrainTimeout time.Duration `mapstructure:"drain_timeout" default:"10s"`
+	// OrderingKey is the dot separated path of a message field. If set, messages with the same key are handled by the
+	// same worker, in the order they were received.
+	OrderingKey string `mapstructure:"ordering_key"`
+	// Redelivery requeues messages the adapter failed to handle instead of stopping the stream, disabled if nil.
+	Redelivery *RedeliveryConfig `mapstructure:"redelivery"`
+	// TargetCheck queries the target from the Chain Watch API on startup, disabled if nil.
+	TargetCheck *TargetCheckConfig `mapstructure:"target_check"`
+}
+
+type ExhaustedAction string
+
+const (
+	// ExhaustedActionStop stops the stream, like a failed message without redelivery.
+	ExhaustedActionStop ExhaustedAction = "stop"
+	// ExhaustedActionSkip continues with the next message. In ack mode the message is acknowledged, so it is lost.
+	ExhaustedActionSkip ExhaustedAction = "skip"
+)
+
+// RedeliveryConfig configures the local redelivery of failed messages. Chain Watch has no negative acknowledgement, so
+// failed messages are requeued to the stream's workers after a delay.
+type RedeliveryConfig struct {
+	// Delay is the delay before the first redelivery, it doubles with every redelivery up to MaxDelay.
+	Delay    time.Duration `mapstructure:"delay" default:"1s" validate:"gt=0"`
+	MaxDelay time.Duration `mapstructure:"max_delay" default:"30s" validate:"gtefield=Delay"`
+	// MaxRedeliveries is the number of times a message is redelivered, unlimited if 0.
+	MaxRedeliveries int `mapstructure:"max_redeliveries" default:"5" validate:"gte=0"`
+	// OnExhausted is applied to a message that still fails after MaxRedeliveries.
+	OnExhausted ExhaustedAction `mapstructure:"on_exhausted" default:"stop" validate:"oneof=stop skip"`
+}
+
+// delay returns the delay before the redelivery following the given number of redeliveries.
+func (c *RedeliveryConfig) delay(redeliveries int) time.Duration {
+	delay := c.Delay
+	for range redeliveries {
+		if delay >= c.MaxDelay {
+			break
+		}
+		delay *= 2
+	}
+	return min(delay, c.MaxDelay)
+}
+
+type ModeMismatchAction string
+
+const (
+	// ModeMismatchActionFail fails creating the stream.
+	ModeMismatchActionFail ModeMismatchAction = "fail"
+	// ModeMismatchActionAuto uses the mode of the target instead of the configured mode.
+	ModeMismatchActionAuto ModeMismatchAction = "auto"
+	// ModeMismatchActionWarn only logs the mismatch.
+	ModeMismatchActionWarn ModeMismatchAction = "warn"
+)
+
+// TargetCheckConfig configures the startup check of the target. A stream mode that does not match the mode of the
+// target loses messages in noack mode or stalls after the first message in ack mode.
+type TargetCheckConfig struct {
+	// APIURL is the url of the Chain Watch API, derived from the stream url if empty.
+	APIURL string `mapstructure:"api_url"`
+	// OnModeMismatch is applied if the stream mode differs from the mode of the target.
+	OnModeMismatch ModeMismatchAction `mapstructure:"on_mode_mismatch" default:"fail" validate:"oneof=fail auto warn"`
+	// BufferPollInterval is the interval the buffer usage of the target is recorded at, it is only recorded on startup
+	// if 0.
+	BufferPollInterval time.Duration `mapstructure:"buffer_poll_interval" default:"1m" validate:"gte=0"`
 }
 
 type Header struct {
 	Key   string `mapstructure:"key"`
 	Value string `mapstructure:"value"`
+	// Secret redacts the value in logs, the values of authentication headers are always redacted.
+	Secret bool `mapstructure:"secret"`
+}
+
+// secretHeaders are the canonical names of the headers that carry credentials.
+var secretHeaders = map[string]struct{}{
+	"Authorization":       {},
+	"Proxy-Authorization": {},
+	"Cookie":              {},
+	"X-Api-Key":           {},
+}
+
+// IsSecret reports whether the value of the header must not be logged.
+func (h Header) IsSecret() bool {
+	_, ok := secretHeaders[http.CanonicalHeaderKey(h.Key)]
+	return h.Secret || ok
+}
+
+// Redacted returns the header with the value replaced by config.Redacted if it is secret.
+func (h Header) Redacted() any {
+	if h.IsSecret() && h.Value != "" {
+		h.Value = config.Redacted
+	}
+	return h
 }
 
 var urlRegex = regexp.MustCompile(`^(ws|wss):\/\/.*?\/targets\/(.*?)\/websocket$`)
 var urlGatewayRegex = regexp.MustCompile(`^wss:\/\/(.+)?svc.blockdaemon.com\/streaming\/v2\/targets\/.*?\/websocket$`)
 
+// TargetId returns the Chain Watch target id from the url, or an empty string if the url is invalid.
+func (c *Config) TargetId() string {
+	matches := urlRegex.FindStringSubmatch(c.URL)
+	if len(matches) != 3 {
+		return ""
+	}
+	return matches[2]
+}
+
 func (c *Config) Validate() error {
 	matches := urlRegex.FindStringSubmatch(c.URL)
 	if len(matches) != 3 {
@@ -1,9 +1,13 @@
 package stream
 
 import (
+	"encoding/json"
 	"testing"
+	"time"
 
+	"github.com/blockdaemon/chain_sink/pkg/config"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestConfig_Validate(t *testing.T) {
@@ -24,3 +28,36 @@ func TestConfig_Validate(t *testing.T) {
 		assert.ErrorIs(t, err, test.err)
 	}
 }
+
+func TestRedeliveryConfig_delay(t *testing.T) {
+	cfg := RedeliveryConfig{Delay: time.Second, MaxDelay: 5 * time.Second}
+	assert.Equal(t, time.Second, cfg.delay(0))
+	assert.Equal(t, 2*time.Second, cfg.delay(1))
+	assert.Equal(t, 4*time.Second, cfg.delay(2))
+	assert.Equal(t, 5*time.Second, cfg.delay(3))
+	assert.Equal(t, 5*time.Second, cfg.delay(100))
+}
+
+func TestHeader_Redacted(t *testing.T) {
+	assert.Equal(t, Header{Key: "authorization", Value: config.Redacted}, Header{Key: "authorization", Value: "Bearer token"}.Redacted())
+	assert.Equal(t, Header{Key: "X-Tenant", Value: config.Redacted, Secret: true}, Header{Key: "X-Tenant", Value: "tenant", Secret: true}.Redacted())
+	assert.Equal(t, Header{Key: "X-Tenant", Value: "tenant"}, Header{Key: "X-Tenant", Value: "tenant"}.Redacted())
+}
+
+func TestConfig_mapRedactsSecrets(t *testing.T) {
+	cfg := Config{
+		URL:    "ws://localhost:8765/targets/ceac6435-b9af-441c-abf3-f78de9bfc32c/websocket",
+		ApiKey: "stream-api-key",
+		Headers: []Header{
+			{Key: "Authorization", Value: "Bearer header-token"},
+			{Key: "X-Signature", Value: "header-signature", Secret: true},
+		},
+	}
+
+	encoded, err := json.Marshal(config.Map(cfg))
+	require.NoError(t, err)
+	for _, secret := range []string{"stream-api-key", "header-token", "header-signature"} {
+		assert.NotContains(t, string(encoded), secret)
+	}
+	assert.Contains(t, string(encoded), `"api_key":"[redacted]"`)
+}
@@ -0,0 +1,128 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/blockdaemon/chain_sink/pkg/chainwatch"
+	"github.com/blockdaemon/chain_sink/pkg/logger"
+	"github.com/blockdaemon/chain_sink/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// checkTarget queries the target from the Chain Watch API, compares its mode with the stream mode and records its
+// buffer usage. In auto mode the stream mode is replaced by the mode of the target.
+func (s *ChainWatchStream) checkTarget(ctx context.Context) error {
+	var err error
+	if s.targets, err = s.cfg.targetClient(); err != nil {
+		return err
+	}
+
+	target, err := s.targets.GetTarget(ctx, s.target)
+	if err != nil {
+		return fmt.Errorf("error checking target %s: %w", s.target, err)
+	}
+	s.recordTargetBuffer(ctx, target)
+
+	s.cfg.Mode, err = checkMode(s.log, &s.cfg, target)
+	return err
+}
+
+// CheckTarget queries the target of the stream from the Chain Watch API and compares its mode with the stream mode,
+// as the target check does on startup. The websocket is not opened.
+func CheckTarget(ctx context.Context, cfg Config) error {
+	client, err := cfg.targetClient()
+	if err != nil {
+		return err
+	}
+
+	target, err := client.GetTarget(ctx, cfg.TargetId())
+	if err != nil {
+		return fmt.Errorf("error checking target %s: %w", cfg.TargetId(), err)
+	}
+
+	_, err = checkMode(logger.Log.With(zap.String("target_id", cfg.TargetId())), &cfg, target)
+	return err
+}
+
+// targetClient returns a client for the Chain Watch API that authenticates with the api key and headers of the
+// stream. The API url is derived from the stream url unless it is configured in the target check.
+func (c *Config) targetClient() (*chainwatch.Client, error) {
+	var apiURL string
+	if c.TargetCheck != nil {
+		apiURL = c.TargetCheck.APIURL
+	}
+	if apiURL == "" {
+		var err error
+		if apiURL, err = chainwatch.APIURLFromWebsocketURL(c.URL); err != nil {
+			return nil, fmt.Errorf("error deriving the Chain Watch API url, configure target_check.api_url: %w", err)
+		}
+	}
+
+	headers := make(http.Header)
+	for _, header := range c.Headers {
+		headers.Add(header.Key, header.Value)
+	}
+	return chainwatch.NewClient(apiURL, c.ApiKey, chainwatch.WithHeaders(headers)), nil
+}
+
+// checkMode compares the mode of the target with the stream mode and returns the mode the stream uses, which is the
+// mode of the target in auto mode. A mismatch fails unless the target check is configured otherwise.
+func checkMode(log *zap.Logger, cfg *Config, target *chainwatch.Target) (StreamMode, error) {
+	targetMode := StreamMode(target.Settings.Mode)
+	if targetMode == "" {
+		log.Warn("target has no mode, not checking the stream mode", zap.String("stream_mode", string(cfg.Mode)))
+		return cfg.Mode, nil
+	}
+	if targetMode == cfg.Mode {
+		log.Debug("stream mode matches the target", zap.String("mode", string(targetMode)))
+		return cfg.Mode, nil
+	}
+
+	action := ModeMismatchActionFail
+	if cfg.TargetCheck != nil {
+		action = cfg.TargetCheck.OnModeMismatch
+	}
+	switch action {
+	case ModeMismatchActionAuto:
+		log.Info("using the mode of the target", zap.String("mode", string(targetMode)),
+			zap.String("configured_mode", string(cfg.Mode)))
+		return targetMode, nil
+	case ModeMismatchActionWarn:
+		log.Warn("stream mode does not match the target", zap.String("stream_mode", string(cfg.Mode)),
+			zap.String("target_mode", string(targetMode)))
+		return cfg.Mode, nil
+	}
+	return cfg.Mode, fmt.Errorf("%w: the stream is configured with %s, target %s has mode %s", ErrModeMismatch, cfg.Mode,
+		cfg.TargetId(), targetMode)
+}
+
+// pollTargetBuffer records the buffer usage of the target every interval until ctx is cancelled. Errors are logged,
+// the stream keeps running without the API.
+func (s *ChainWatchStream) pollTargetBuffer(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		target, err := s.targets.GetTarget(ctx, s.target)
+		if err != nil {
+			if ctx.Err() == nil {
+				s.log.Warn("error polling target buffer usage", zap.Error(err))
+			}
+			continue
+		}
+		s.recordTargetBuffer(ctx, target)
+	}
+}
+
+func (s *ChainWatchStream) recordTargetBuffer(ctx context.Context, target *chainwatch.Target) {
+	metrics.G.RecordTargetBuffer(ctx, s.target, int64(target.CurrentBufferCount), int64(target.MaxBufferCount))
+}
@@ -0,0 +1,106 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/blockdaemon/chain_sink/pkg/chainwatch"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTargetAPI(t *testing.T, target chainwatch.Target) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/targets/"+target.Id {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		assert.Equal(t, "test-key", r.Header.Get("x-api-key"))
+		_ = json.NewEncoder(w).Encode(target)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestNewChainWatchStream_targetCheck(t *testing.T) {
+	const targetId = "5b0c1d0e-7d2f-4a8e-9f41-2f0d7a3b6c11"
+	api := newTargetAPI(t, chainwatch.Target{
+		Id:             targetId,
+		Settings:       chainwatch.TargetSettings{Mode: chainwatch.TargetModeNoAck},
+		MaxBufferCount: 100,
+	})
+
+	tests := []struct {
+		name     string
+		mode     StreamMode
+		action   ModeMismatchAction
+		wantMode StreamMode
+		wantErr  error
+	}{
+		{name: "matching mode", mode: StreamModeNoAck, action: ModeMismatchActionFail, wantMode: StreamModeNoAck},
+		{name: "fail", mode: StreamModeAck, action: ModeMismatchActionFail, wantErr: ErrModeMismatch},
+		{name: "auto", mode: StreamModeAck, action: ModeMismatchActionAuto, wantMode: StreamModeNoAck},
+		{name: "warn", mode: StreamModeAck, action: ModeMismatchActionWarn, wantMode: StreamModeAck},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream, err := NewChainWatchStream(context.Background(), Config{
+				URL:            fmt.Sprintf("ws://localhost:%d/targets/%s/websocket", testServerPort, targetId),
+				Mode:           tt.mode,
+				ApiKey:         "test-key",
+				WorkerPoolSize: 1,
+				TargetCheck:    &TargetCheckConfig{APIURL: api.URL, OnModeMismatch: tt.action},
+			})
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			defer stream.conn.CloseNow()
+			assert.Equal(t, tt.wantMode, stream.cfg.Mode)
+		})
+	}
+}
+
+func TestNewChainWatchStream_targetCheckNotFound(t *testing.T) {
+	api := newTargetAPI(t, chainwatch.Target{Id: "another-target"})
+
+	_, err := NewChainWatchStream(context.Background(), Config{
+		URL:            fmt.Sprintf("ws://localhost:%d/targets/%s/websocket", testServerPort, "0f8e9b2a-3c4d-4e5f-8a6b-7c8d9e0f1a2b"),
+		Mode:           StreamModeAck,
+		ApiKey:         "test-key",
+		WorkerPoolSize: 1,
+		TargetCheck:    &TargetCheckConfig{APIURL: api.URL, OnModeMismatch: ModeMismatchActionFail},
+	})
+	assert.True(t, chainwatch.IsNotFound(err))
+}
+
+func TestCheckTarget_headers(t *testing.T) {
+	const targetId = "9d3e2b1a-4c5f-4e6d-8a7b-1c2d3e4f5a6b"
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer header-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(chainwatch.Target{Id: targetId, Settings: chainwatch.TargetSettings{Mode: chainwatch.TargetModeAck}})
+	}))
+	t.Cleanup(api.Close)
+
+	cfg := Config{
+		URL:         fmt.Sprintf("ws://localhost:%d/targets/%s/websocket", testServerPort, targetId),
+		Mode:        StreamModeAck,
+		TargetCheck: &TargetCheckConfig{APIURL: api.URL},
+	}
+	assert.ErrorContains(t, CheckTarget(context.Background(), cfg), "status 401")
+
+	cfg.Headers = []Header{{Key: "Authorization", Value: "Bearer header-token"}}
+	require.NoError(t, CheckTarget(context.Background(), cfg), "the stream headers authenticate the API requests")
+
+	cfg.Mode = StreamModeNoAck
+	assert.ErrorIs(t, CheckTarget(context.Background(), cfg), ErrModeMismatch)
+}
@@ -4,10 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/blockdaemon/chain_sink/pkg/chainwatch"
+	"github.com/blockdaemon/chain_sink/pkg/config"
 	"github.com/blockdaemon/chain_sink/pkg/logger"
 	"github.com/blockdaemon/chain_sink/pkg/metrics"
 	"github.com/coder/websocket"
@@ -20,14 +25,43 @@ var (
 	ErrInvalidUrl      = errors.New("invalid url: make sure the url is in the format wss://<host>:<port>/targets/<target_id>/websocket")
 	ErrInvalidTargetId = errors.New("invalid target id: the url is valid, but the target id is not a valid uuid")
 	ErrMissingApiKey   = errors.New("API key is required: please specify the API key to authenticate with the Chain Watch API")
+	ErrStreamClosed    = errors.New("stream is closed")
+	ErrModeMismatch    = errors.New("stream mode does not match the mode of the Chain Watch target")
 )
 
 type ChainWatchStream struct {
 	sync.RWMutex
-	cfg Config
+	cfg    Config
+	target string
+	log    *zap.Logger
+
+	conn   *websocket.Conn
+	closed bool
+	// lanes holds the work channels, there is a lane per worker if an ordering key is configured and a single lane
+	// shared by all workers otherwise.
+	lanes       []chan delivery
+	orderingKey []string
+
+	// inFlight and completions are used for async adapters, inFlight acts as a semaphore limiting the number of
+	// uncompleted messages and completions receives the results from the adapter callbacks.
+	inFlight    chan struct{}
+	completions chan completion
+	// acks are written to the websocket by runAckWriter, so the workers do not write concurrently.
+	acks chan []byte
+	// targets queries the target for the buffer usage, nil if the target check is disabled.
+	targets *chainwatch.Client
+}
+
+// delivery is a message handed to the workers, redeliveries counts how often it was requeued after failing.
+type delivery struct {
+	message      []byte
+	redeliveries int
+}
 
-	conn     *websocket.Conn
-	workChan chan []byte
+type completion struct {
+	delivery delivery
+	ack      []byte
+	err      error
 }
 
 func NewChainWatchStream(ctx context.Context, cfg Config) (*ChainWatchStream, error) {
@@ -35,9 +69,29 @@ func NewChainWatchStream(ctx context.Context, cfg Config) (*ChainWatchStream, er
 		return nil, err
 	}
 
+	maxInFlight := max(cfg.MaxInFlight, 1)
+	target := cfg.TargetId()
 	stream := &ChainWatchStream{
-		cfg:      cfg,
-		workChan: make(chan []byte, cfg.WorkerPoolSize),
+		cfg:         cfg,
+		target:      target,
+		log:         logger.Log.With(zap.String("target_id", target)),
+		inFlight:    make(chan struct{}, maxInFlight),
+		completions: make(chan completion, maxInFlight),
+	}
+
+	if cfg.OrderingKey != "" {
+		stream.orderingKey = strings.Split(cfg.OrderingKey, ".")
+		for range max(cfg.WorkerPoolSize, 1) {
+			stream.lanes = append(stream.lanes, make(chan delivery, 1))
+		}
+	} else {
+		stream.lanes = []chan delivery{make(chan delivery, cfg.WorkerPoolSize)}
+	}
+
+	if cfg.TargetCheck != nil {
+		if err := stream.checkTarget(ctx); err != nil {
+			return nil, err
+		}
 	}
 
 	if err := stream.establishConnection(ctx); err != nil {
@@ -51,19 +105,27 @@ func (s *ChainWatchStream) establishConnection(ctx context.Context) error {
 	s.Lock()
 	defer s.Unlock()
 
+	if s.closed {
+		return ErrStreamClosed
+	}
+
 	if s.conn != nil {
 		_ = s.conn.Close(websocket.StatusNormalClosure, "reestablishing connection")
 	}
 
 	url := s.cfg.URL
 	headers := make(http.Header)
+	// loggedHeaders are the headers with the secret values redacted.
+	loggedHeaders := make(http.Header)
 
 	if s.cfg.ApiKey != "" {
 		headers.Add("x-api-key", s.cfg.ApiKey)
+		loggedHeaders.Add("x-api-key", config.Redacted)
 	}
 
 	for _, header := range s.cfg.Headers {
 		headers.Add(header.Key, header.Value)
+		loggedHeaders.Add(header.Key, header.Redacted().(Header).Value)
 	}
 
 	conn, resp, err := websocket.Dial(ctx, url, &websocket.DialOptions{
@@ -71,11 +133,15 @@ func (s *ChainWatchStream) establishConnection(ctx context.Context) error {
 	})
 	if err != nil {
 		var body []byte
-		if resp != nil && resp.Body != nil {
-			body, _ = io.ReadAll(resp.Body)
-			defer resp.Body.Close()
+		var status int
+		if resp != nil {
+			status = resp.StatusCode
+			if resp.Body != nil {
+				body, _ = io.ReadAll(resp.Body)
+				defer resp.Body.Close()
+			}
 		}
-		logger.Log.Error("error dialing websocket", zap.Error(err), zap.String("url", url), zap.Any("headers", headers), zap.String("response", string(body)), zap.Int("status", resp.StatusCode))
+		s.log.Error("error dialing websocket", zap.Error(err), zap.String("url", url), zap.Any("headers", loggedHeaders), zap.String("response", string(body)), zap.Int("status", status))
 		return err
 	}
 	if resp != nil && resp.Body != nil {
@@ -106,62 +172,303 @@ func (s *ChainWatchStream) reestablishConnection(ctx context.Context, err error)
 		return err
 	}
 
-	logger.Log.Warn("reestablishing connection after websocket close", zap.Error(err))
+	s.log.Warn("reestablishing connection after websocket close", zap.Error(err))
 	return s.establishConnection(ctx)
 }
 
+// ForwardMessagesToAdapter reads messages from the websocket and forwards them to the adapter until ctx is cancelled
+// or an error occurs. Shutting down happens in two phases: when ctx is cancelled the stream stops reading, then the
+// messages that were already read are handled and acknowledged using a separate drain context, limited by the drain
+// timeout. Finally the websocket is closed with a normal closure.
 func (s *ChainWatchStream) ForwardMessagesToAdapter(ctx context.Context, adapter Adapter) error {
-	group, gCtx := errgroup.WithContext(ctx)
+	drainCtx, cancelDrain := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelDrain()
+
+	stopDrainTimer := context.AfterFunc(ctx, func() {
+		s.log.Info("draining stream", zap.Duration("drain_timeout", s.cfg.DrainTimeout))
+		time.AfterFunc(s.cfg.DrainTimeout, cancelDrain)
+	})
+	defer stopDrainTimer()
+
+	group, gCtx := errgroup.WithContext(drainCtx)
+
+	if s.targets != nil && s.cfg.TargetCheck.BufferPollInterval > 0 {
+		pollCtx, stopPolling := context.WithCancel(ctx)
+		defer stopPolling()
+		go s.pollTargetBuffer(pollCtx, s.cfg.TargetCheck.BufferPollInterval)
+	}
+
+	// Every in flight message of an async adapter and every worker can queue an ack without waiting for the writer.
+	s.acks = make(chan []byte, max(s.cfg.MaxInFlight, 1)+s.cfg.WorkerPoolSize)
+
+	// Cancelling the context of a websocket read closes the connection, so the reader uses the drain context to keep
+	// the connection open for acknowledgements and is stopped by closing the connection once the stream is drained.
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- s.readFromWebsocket(ctx, gCtx)
+	}()
 	group.Go(func() error {
-		return s.readFromWebsocket(gCtx)
+		select {
+		case err := <-readErr:
+			return err
+		case <-ctx.Done():
+			return nil
+		case <-gCtx.Done():
+			return nil
+		}
 	})
 
-	logger.Log.Debug("starting worker pool", zap.Int("worker_pool_size", s.cfg.WorkerPoolSize))
-	for range s.cfg.WorkerPoolSize {
+	var workers sync.WaitGroup
+	workersDone := make(chan struct{})
+
+	s.log.Debug("starting worker pool", zap.Int("worker_pool_size", s.cfg.WorkerPoolSize), zap.Int("lanes", len(s.lanes)))
+	for i := range s.cfg.WorkerPoolSize {
+		workers.Add(1)
 		group.Go(func() error {
-			return s.runWorker(gCtx, adapter)
+			defer workers.Done()
+			return s.runWorker(ctx, gCtx, adapter, s.lanes[i%len(s.lanes)])
 		})
 	}
 
-	return group.Wait()
+	go func() {
+		workers.Wait()
+		close(workersDone)
+	}()
+
+	completionsDone := make(chan struct{})
+	if _, ok := adapter.(AsyncAdapter); ok {
+		group.Go(func() error {
+			defer close(completionsDone)
+			return s.runCompletions(ctx, gCtx, workersDone)
+		})
+	} else {
+		close(completionsDone)
+	}
+
+	// The ack writer stops once the workers and completions are done and every queued ack is written.
+	go func() {
+		<-workersDone
+		<-completionsDone
+		close(s.acks)
+	}()
+	group.Go(func() error {
+		return s.runAckWriter(gCtx, s.acks)
+	})
+
+	err := group.Wait()
+	s.close()
+
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
 }
 
-func (s *ChainWatchStream) readFromWebsocket(ctx context.Context) error {
+// close closes the websocket connection with a normal closure and prevents it from being reestablished.
+func (s *ChainWatchStream) close() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+
+	if s.conn != nil {
+		if err := s.conn.Close(websocket.StatusNormalClosure, "shutting down"); err != nil {
+			s.log.Debug("error closing websocket", zap.Error(err))
+		}
+	}
+}
+
+// readFromWebsocket reads messages into the work channel until ctx is cancelled. The websocket reads use readCtx.
+func (s *ChainWatchStream) readFromWebsocket(ctx context.Context, readCtx context.Context) error {
 	for {
 		// Message type is always text or binary, so we don't need to check it.
 		// pings, pongs and closures are handled by the websocket library itself.
-		_, message, err := s.conn.Read(ctx)
+		_, message, err := s.conn.Read(readCtx)
 		if err != nil {
-			logger.Log.Error("error reading from websocket", zap.Error(err))
-			if err := s.reestablishConnection(ctx, err); err != nil {
+			if ctx.Err() != nil || readCtx.Err() != nil {
+				return nil
+			}
+			s.log.Error("error reading from websocket", zap.Error(err))
+			if err := s.reestablishConnection(readCtx, err); err != nil {
 				return err
 			}
 			continue
 		}
 
+		// Messages read after ctx is cancelled are not forwarded, they are not acknowledged and will be redelivered.
+		if ctx.Err() != nil {
+			return nil
+		}
+
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
-		case s.workChan <- message:
-			metrics.G.RecordMessagesReceived(ctx)
+			return nil
+		case <-readCtx.Done():
+			return nil
+		case s.lane(message) <- delivery{message: message}:
+			metrics.G.RecordMessagesReceived(ctx, s.target)
+		}
+	}
+}
+
+// lane returns the work channel for the message. With an ordering key the lane is chosen by the hash of the key,
+// messages without the key share the lane of an empty key.
+func (s *ChainWatchStream) lane(message []byte) chan delivery {
+	if len(s.lanes) == 1 {
+		return s.lanes[0]
+	}
+
+	parser := parserPool.Get()
+	defer parserPool.Put(parser)
+
+	hash := fnv.New32a()
+	if parsed, err := parser.ParseBytes(message); err == nil {
+		if key := parsed.Get(s.orderingKey...); key != nil {
+			if key.Type() == fastjson.TypeString {
+				_, _ = hash.Write(key.GetStringBytes())
+			} else {
+				_, _ = hash.Write(key.MarshalTo(nil))
+			}
 		}
 	}
+	return s.lanes[hash.Sum32()%uint32(len(s.lanes))]
 }
 
-func (s *ChainWatchStream) runWorker(ctx context.Context, adapter Adapter) error {
+// runWorker handles messages from the work channel using workCtx. When ctx is cancelled the messages left in the
+// work channel are handled before the worker stops.
+func (s *ChainWatchStream) runWorker(ctx context.Context, workCtx context.Context, adapter Adapter, work <-chan delivery) error {
 	for {
 		select {
+		case <-workCtx.Done():
+			return workCtx.Err()
 		case <-ctx.Done():
-			return ctx.Err()
-		case message := <-s.workChan:
-			if err := s.handleMessage(ctx, message, adapter); err != nil {
+			for {
+				select {
+				case <-workCtx.Done():
+					return workCtx.Err()
+				case d := <-work:
+					if err := s.forwardMessage(ctx, workCtx, d, adapter); err != nil {
+						return err
+					}
+				default:
+					return nil
+				}
+			}
+		case d := <-work:
+			if err := s.forwardMessage(ctx, workCtx, d, adapter); err != nil {
 				return err
 			}
-			metrics.G.RecordMessagesForwardedToAdapter(ctx)
 		}
 	}
 }
 
+// forwardMessage handles the delivery using workCtx, a message the adapter failed to handle is redelivered until ctx
+// is cancelled if redelivery is configured. With an ordering key the message is retried in place, which blocks its
+// lane so the later messages with the same key wait for it.
+func (s *ChainWatchStream) forwardMessage(ctx context.Context, workCtx context.Context, d delivery, adapter Adapter) error {
+	for {
+		err := s.handleMessage(workCtx, d, adapter)
+		if err == nil {
+			metrics.G.RecordMessagesForwardedToAdapter(workCtx, s.target)
+			return nil
+		}
+
+		var adapterErr *adapterError
+		if !errors.As(err, &adapterErr) {
+			return err
+		}
+		if s.orderingKey == nil {
+			return s.redeliver(ctx, workCtx, d, adapterErr.err)
+		}
+
+		delay, ok, err := s.redelivery(ctx, workCtx, &d, adapterErr.err)
+		if !ok {
+			return err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// adapterError marks errors of the adapter, which can be redelivered, as opposed to invalid messages.
+type adapterError struct {
+	err error
+}
+
+func (e *adapterError) Error() string { return e.err.Error() }
+func (e *adapterError) Unwrap() error { return e.err }
+
+// redeliver requeues the delivery that failed with err after the redelivery delay, unless ctx is cancelled by then.
+// It returns an error if the stream has to stop.
+func (s *ChainWatchStream) redeliver(ctx context.Context, workCtx context.Context, d delivery, err error) error {
+	delay, ok, err := s.redelivery(ctx, workCtx, &d, err)
+	if !ok {
+		return err
+	}
+
+	time.AfterFunc(delay, func() {
+		select {
+		case <-ctx.Done():
+		case s.lane(d.message) <- d:
+		}
+	})
+	return nil
+}
+
+// redelivery counts the redelivery of the delivery that failed with err and returns the delay before it is handled
+// again. ok is false if it is not redelivered, then an error is returned if the stream has to stop, because
+// redelivery is disabled or the delivery was redelivered MaxRedeliveries times. A skipped delivery is acknowledged
+// using workCtx.
+func (s *ChainWatchStream) redelivery(ctx context.Context, workCtx context.Context, d *delivery, err error) (delay time.Duration, ok bool, stopErr error) {
+	cfg := s.cfg.Redelivery
+	if cfg == nil {
+		return 0, false, err
+	}
+
+	if cfg.MaxRedeliveries > 0 && d.redeliveries >= cfg.MaxRedeliveries {
+		if cfg.OnExhausted != ExhaustedActionSkip {
+			return 0, false, fmt.Errorf("message failed after %d redeliveries: %w", d.redeliveries, err)
+		}
+		// In ack mode Chain Watch sends the next message only after the skipped one was acknowledged, so it is acked
+		// and lost.
+		s.log.Error("skipping message after redeliveries", zap.Int("redeliveries", d.redeliveries), zap.Error(err))
+		return 0, false, s.ackSkipped(workCtx, d.message)
+	}
+
+	// Messages are not redelivered while draining, Chain Watch redelivers them as they are not acknowledged.
+	if ctx.Err() != nil {
+		s.log.Warn("not requeueing failed message while draining", zap.Error(err))
+		return 0, false, nil
+	}
+
+	delay = cfg.delay(d.redeliveries)
+	d.redeliveries++
+	s.log.Warn("requeueing failed message", zap.Int("redelivery", d.redeliveries), zap.Duration("delay", delay), zap.Error(err))
+	metrics.G.RecordMessagesRequeued(ctx, s.target)
+	return delay, true, nil
+}
+
+// ackSkipped acknowledges the skipped message in ack mode.
+func (s *ChainWatchStream) ackSkipped(ctx context.Context, message []byte) error {
+	if s.cfg.Mode == StreamModeNoAck {
+		return nil
+	}
+
+	ack, err := newAck(message)
+	if err != nil {
+		return err
+	}
+	return s.queueAck(ctx, ack)
+}
+
 var parserPool = fastjson.ParserPool{}
 var arenaPool = fastjson.ArenaPool{}
 
@@ -171,31 +478,57 @@ var bytesPool = sync.Pool{
 	},
 }
 
-func (s *ChainWatchStream) handleMessage(ctx context.Context, message []byte, adapter Adapter) error {
+// handleMessage hands the message to the adapter, errors of the adapter are returned as an *adapterError.
+func (s *ChainWatchStream) handleMessage(ctx context.Context, d delivery, adapter Adapter) error {
 
 	// NoAck mode does not require any acknowledgement, so we can just forward the message to the adapter.
 	// this is much faster and simpler than ack mode, but less resilient. If the adapter fails the message will be lost.
 	if s.cfg.Mode == StreamModeNoAck {
-		return adapter.HandleMessage(ctx, message)
+		if asyncAdapter, ok := adapter.(AsyncAdapter); ok {
+			return s.handleMessageAsync(ctx, d, nil, asyncAdapter)
+		}
+		if err := adapter.HandleMessage(ctx, d.message); err != nil {
+			return &adapterError{err: err}
+		}
+		return nil
 	}
 
 	// Ack mode requires an acknowledgement, so we parse the message ID and only send it back as acknowledgement
 	// when the message is successfully handled by the adapter.
+	ackBytes, err := newAck(d.message)
+	if err != nil {
+		return err
+	}
+
+	if asyncAdapter, ok := adapter.(AsyncAdapter); ok {
+		if err := s.handleMessageAsync(ctx, d, ackBytes, asyncAdapter); err != nil {
+			bytesPool.Put(ackBytes)
+			return err
+		}
+		return nil
+	}
+
+	if err := adapter.HandleMessage(ctx, d.message); err != nil {
+		bytesPool.Put(ackBytes)
+		return &adapterError{err: err}
+	}
+
+	return s.queueAck(ctx, ackBytes)
+}
+
+// newAck returns the ack of the message, the ack is written by the ack writer, which returns the buffer to the pool.
+func newAck(message []byte) ([]byte, error) {
 	parser := parserPool.Get()
 	defer parserPool.Put(parser)
 
 	parsed, err := parser.ParseBytes(message)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	messageId := parsed.Get("id")
+	messageId := parsed.Get(chainwatch.FieldId)
 	if messageId == nil {
-		return fmt.Errorf("message id is required")
-	}
-
-	if err := adapter.HandleMessage(ctx, message); err != nil {
-		return err
+		return nil, fmt.Errorf("message id is required")
 	}
 
 	arena := arenaPool.Get()
@@ -203,25 +536,127 @@ func (s *ChainWatchStream) handleMessage(ctx context.Context, message []byte, ad
 
 	ack := arena.NewObject()
 	ack.Set("id", messageId)
+	return ack.MarshalTo(bytesPool.Get().([]byte)[:0]), nil
+}
 
-	bytes := bytesPool.Get().([]byte)
-	defer func() {
-		bytes = bytes[:0]
-		bytesPool.Put(bytes)
-	}()
+// queueAck hands the ack to the ack writer.
+func (s *ChainWatchStream) queueAck(ctx context.Context, ack []byte) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case s.acks <- ack:
+		return nil
+	}
+}
+
+// maxCoalescedAcks limits the number of acks written while holding the connection lock, so a reconnect is not
+// delayed indefinitely.
+const maxCoalescedAcks = 128
+
+// runAckWriter writes the acks to the websocket until acks is closed. Chain Watch expects one ack per frame, so acks
+// are not combined, instead the acks that queued up while a frame was written are written back to back by this
+// single goroutine.
+func (s *ChainWatchStream) runAckWriter(ctx context.Context, acks <-chan []byte) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ack, ok := <-acks:
+			if !ok {
+				return nil
+			}
+			if err := s.writeAcks(ctx, ack, acks); err != nil {
+				return err
+			}
+		}
+	}
+}
 
-	// The library supports concurrent writes, we take a read lock to prevent race conditions
-	// in case the connection is reestablished.
+// writeAcks writes the ack and the acks queued behind it. If a write fails the connection is reestablished, the acks
+// that were not written are lost and Chain Watch redelivers their messages.
+func (s *ChainWatchStream) writeAcks(ctx context.Context, ack []byte, acks <-chan []byte) error {
+	// The read lock prevents the connection from being reestablished while writing.
 	s.RLock()
-	err = s.conn.Write(ctx, websocket.MessageText, ack.MarshalTo(bytes))
+	var err error
+	for written := 1; ; written++ {
+		err = s.conn.Write(ctx, websocket.MessageText, ack)
+		bytesPool.Put(ack[:0])
+		if err != nil {
+			break
+		}
+		metrics.G.RecordMessagesAcked(ctx, s.target)
+
+		if written == maxCoalescedAcks {
+			break
+		}
+		var ok bool
+		select {
+		case ack, ok = <-acks:
+		default:
+		}
+		if !ok {
+			break
+		}
+	}
 	s.RUnlock()
+
 	if err != nil {
-		if err := s.reestablishConnection(ctx, err); err != nil {
-			return err
-		}
+		return s.reestablishConnection(ctx, err)
 	}
+	return nil
+}
 
-	metrics.G.RecordMessagesAcked(ctx)
+// handleMessageAsync hands the message to the async adapter without waiting for the delivery. The ack, if any,
+// is sent by runCompletions once the adapter reports success.
+func (s *ChainWatchStream) handleMessageAsync(ctx context.Context, d delivery, ack []byte, adapter AsyncAdapter) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case s.inFlight <- struct{}{}:
+	}
+
+	err := adapter.HandleMessageAsync(ctx, d.message, func(err error) {
+		// completions has the same capacity as inFlight, so this never blocks.
+		s.completions <- completion{delivery: d, ack: ack, err: err}
+	})
+	if err != nil {
+		<-s.inFlight
+		return &adapterError{err: err}
+	}
 
 	return nil
 }
+
+// runCompletions sends the acks for completed async messages using workCtx, failed messages are requeued until ctx
+// is cancelled if redelivery is configured. It stops once the workers are done and all in flight messages are
+// completed.
+func (s *ChainWatchStream) runCompletions(ctx context.Context, workCtx context.Context, workersDone <-chan struct{}) error {
+	draining := false
+	for {
+		if draining && len(s.inFlight) == 0 {
+			return nil
+		}
+
+		select {
+		case <-workCtx.Done():
+			return workCtx.Err()
+		case <-workersDone:
+			draining = true
+			workersDone = nil
+		case c := <-s.completions:
+			<-s.inFlight
+			if c.err != nil {
+				if err := s.redeliver(ctx, workCtx, c.delivery, c.err); err != nil {
+					return err
+				}
+				continue
+			}
+			if c.ack == nil {
+				continue
+			}
+			if err := s.queueAck(workCtx, c.ack); err != nil {
+				return err
+			}
+		}
+	}
+}
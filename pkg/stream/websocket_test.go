@@ -2,15 +2,19 @@ package stream
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/blockdaemon/chain_sink/internal/logtest"
 	"github.com/blockdaemon/chain_sink/pkg/logger"
 	"github.com/blockdaemon/chain_sink/pkg/stream/mock_stream"
 	"github.com/coder/websocket"
@@ -126,6 +130,120 @@ func TestWebsocket_AckMode(t *testing.T) {
 	assert.True(t, testSuccess)
 }
 
+func TestWebsocket_AckModeGracefulDrain(t *testing.T) {
+	const targetId = "5f0d2b8e-3c1a-4e57-8d4b-6a9f0e2c7b31"
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	adapter := mock_stream.NewMockAdapter(t)
+	adapter.EXPECT().HandleMessage(mock.Anything, []byte(testMessageOne)).RunAndReturn(func(adapterCtx context.Context, _ []byte) error {
+		// the stream is cancelled while the message is being handled, the adapter should not notice.
+		cancel()
+		time.Sleep(50 * time.Millisecond)
+		return adapterCtx.Err()
+	})
+
+	stream, err := NewChainWatchStream(context.Background(), Config{
+		URL:            fmt.Sprintf("ws://localhost:%d/targets/%s/websocket", testServerPort, targetId),
+		Mode:           StreamModeAck,
+		WorkerPoolSize: 1,
+		DrainTimeout:   5 * time.Second,
+	})
+	require.NoError(t, err)
+
+	serverConn, err := testServer.waitForConn(targetId, 5*time.Second)
+	require.NoError(t, err)
+
+	forwardErr := make(chan error, 1)
+	go func() {
+		forwardErr <- stream.ForwardMessagesToAdapter(ctx, adapter)
+	}()
+
+	serverCtx, serverCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer serverCancel()
+
+	require.NoError(t, serverConn.Conn.Write(serverCtx, websocket.MessageText, []byte(testMessageOne)))
+
+	_, message, err := serverConn.Conn.Read(serverCtx)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id":"test-message-one"}`, string(message))
+
+	_, _, err = serverConn.Conn.Read(serverCtx)
+	assert.Equal(t, websocket.StatusNormalClosure, websocket.CloseStatus(err))
+
+	assert.ErrorIs(t, <-forwardErr, context.Canceled)
+}
+
+type asyncTestAdapter struct {
+	messages chan []byte
+	done     chan func(error)
+}
+
+func (a *asyncTestAdapter) HandleMessage(context.Context, []byte) error {
+	return errors.New("HandleMessage should not be called for async adapters")
+}
+
+func (a *asyncTestAdapter) HandleMessageAsync(_ context.Context, message []byte, done func(error)) error {
+	a.messages <- message
+	a.done <- done
+	return nil
+}
+
+func TestWebsocket_AckModeAsync(t *testing.T) {
+	const targetId = "0b0c6c3e-5d2f-4f7c-9a59-2f5c1c3a7a10"
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	adapter := &asyncTestAdapter{messages: make(chan []byte, 1), done: make(chan func(error), 1)}
+
+	stream, err := NewChainWatchStream(context.Background(), Config{
+		URL:            fmt.Sprintf("ws://localhost:%d/targets/%s/websocket", testServerPort, targetId),
+		Mode:           StreamModeAck,
+		WorkerPoolSize: 1,
+		MaxInFlight:    10,
+	})
+	require.NoError(t, err)
+
+	var testSuccess bool
+
+	group, gCtx := errgroup.WithContext(ctx)
+	group.Go(func() error {
+		return stream.ForwardMessagesToAdapter(gCtx, adapter)
+	})
+
+	serverConn, err := testServer.waitForConn(targetId, 5*time.Second)
+	require.NoError(t, err)
+
+	group.Go(func() error {
+		return serverConn.Conn.Write(gCtx, websocket.MessageText, []byte(testMessageOne))
+	})
+
+	var completed atomic.Bool
+	group.Go(func() error {
+		// The message is accepted by the adapter, but the ack must only be sent once the adapter completes it.
+		assert.Equal(t, testMessageOne, string(<-adapter.messages))
+		done := <-adapter.done
+		time.Sleep(50 * time.Millisecond)
+		completed.Store(true)
+		done(nil)
+		return nil
+	})
+
+	group.Go(func() error {
+		_, message, err := serverConn.Conn.Read(gCtx)
+		assert.NoError(t, err)
+		assert.True(t, completed.Load())
+		assert.JSONEq(t, `{"id":"test-message-one"}`, string(message))
+		cancel()
+		testSuccess = true
+		return nil
+	})
+
+	err = group.Wait()
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.True(t, testSuccess)
+}
+
 // Below code is a test server for the websocket connection. It is used to test the websocket connection in isolation.
 type TestWebsocketConn struct {
 	Conn *websocket.Conn
@@ -234,3 +352,361 @@ func (t *TestServer) Close(ctx context.Context) error {
 	t.conns = make(map[string]*TestWebsocketConn)
 	return t.server.Shutdown(ctx)
 }
+
+// orderingAdapter records the sequence numbers per key, handling is slowed down to let workers overtake each other.
+// The messages in failures fail the given number of times before they are handled.
+type orderingAdapter struct {
+	sync.Mutex
+	failures  map[int]int
+	sequences map[string][]int
+	received  int
+	done      chan struct{}
+	expected  int
+}
+
+func (a *orderingAdapter) HandleMessage(_ context.Context, message []byte) error {
+	var parsed struct {
+		Key      string `json:"key"`
+		Sequence int    `json:"sequence"`
+	}
+	if err := json.Unmarshal(message, &parsed); err != nil {
+		return err
+	}
+	time.Sleep(time.Duration(parsed.Sequence%3) * time.Millisecond)
+
+	a.Lock()
+	defer a.Unlock()
+	if a.failures[parsed.Sequence] > 0 {
+		a.failures[parsed.Sequence]--
+		return errors.New("adapter failed")
+	}
+	a.sequences[parsed.Key] = append(a.sequences[parsed.Key], parsed.Sequence)
+	if a.received++; a.received == a.expected {
+		close(a.done)
+	}
+	return nil
+}
+
+func TestWebsocket_orderingKey(t *testing.T) {
+	const targetId = "0b8e1f5c-7d2a-4c39-9e64-3f1a8b7c2d90"
+	const messages = 60
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	adapter := &orderingAdapter{sequences: make(map[string][]int), done: make(chan struct{}), expected: messages}
+
+	stream, err := NewChainWatchStream(context.Background(), Config{
+		URL:            fmt.Sprintf("ws://localhost:%d/targets/%s/websocket", testServerPort, targetId),
+		Mode:           StreamModeNoAck,
+		WorkerPoolSize: 4,
+		OrderingKey:    "log.key",
+	})
+	require.NoError(t, err)
+	assert.Len(t, stream.lanes, 4)
+
+	group, gCtx := errgroup.WithContext(ctx)
+	group.Go(func() error {
+		return stream.ForwardMessagesToAdapter(gCtx, adapter)
+	})
+
+	serverConn, err := testServer.waitForConn(targetId, 5*time.Second)
+	require.NoError(t, err)
+	for i := range messages {
+		message := fmt.Sprintf(`{"key":"k%d","sequence":%d,"log":{"key":"k%d"}}`, i%5, i, i%5)
+		require.NoError(t, serverConn.Conn.Write(ctx, websocket.MessageText, []byte(message)))
+	}
+
+	select {
+	case <-adapter.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("messages were not handled")
+	}
+	cancel()
+	assert.ErrorIs(t, group.Wait(), context.Canceled)
+
+	for key, sequences := range adapter.sequences {
+		assert.IsIncreasing(t, sequences, "messages with key %s are out of order", key)
+	}
+}
+
+func TestWebsocket_orderingKeyRedelivery(t *testing.T) {
+	const targetId = "5e9a2c7d-1b4f-4d86-a3e0-9c7b6f2d1e48"
+	const messages = 20
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	adapter := &orderingAdapter{failures: map[int]int{0: 2, 7: 1}, sequences: make(map[string][]int), done: make(chan struct{}), expected: messages}
+
+	stream, err := NewChainWatchStream(context.Background(), Config{
+		URL:            fmt.Sprintf("ws://localhost:%d/targets/%s/websocket", testServerPort, targetId),
+		Mode:           StreamModeNoAck,
+		WorkerPoolSize: 2,
+		OrderingKey:    "log.key",
+		Redelivery:     &RedeliveryConfig{Delay: 5 * time.Millisecond, MaxDelay: 10 * time.Millisecond, OnExhausted: ExhaustedActionStop},
+	})
+	require.NoError(t, err)
+
+	group, gCtx := errgroup.WithContext(ctx)
+	group.Go(func() error {
+		return stream.ForwardMessagesToAdapter(gCtx, adapter)
+	})
+
+	serverConn, err := testServer.waitForConn(targetId, 5*time.Second)
+	require.NoError(t, err)
+	for i := range messages {
+		message := fmt.Sprintf(`{"key":"k%d","sequence":%d,"log":{"key":"k%d"}}`, i%2, i, i%2)
+		require.NoError(t, serverConn.Conn.Write(ctx, websocket.MessageText, []byte(message)))
+	}
+
+	select {
+	case <-adapter.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("messages were not handled")
+	}
+	cancel()
+	assert.ErrorIs(t, group.Wait(), context.Canceled)
+
+	// The failed messages are retried in place, the later messages with the same key wait for them.
+	for key, sequences := range adapter.sequences {
+		assert.Len(t, sequences, messages/2)
+		assert.IsIncreasing(t, sequences, "messages with key %s are out of order", key)
+	}
+}
+
+type acceptingAdapter struct{}
+
+func (acceptingAdapter) HandleMessage(context.Context, []byte) error {
+	return nil
+}
+
+func TestWebsocket_ackWriter(t *testing.T) {
+	const targetId = "6a3f0d2e-91c4-4b7e-8d15-c2e7f4a9b031"
+	const messages = 50
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := NewChainWatchStream(context.Background(), Config{
+		URL:            fmt.Sprintf("ws://localhost:%d/targets/%s/websocket", testServerPort, targetId),
+		Mode:           StreamModeAck,
+		WorkerPoolSize: 8,
+	})
+	require.NoError(t, err)
+
+	group, gCtx := errgroup.WithContext(ctx)
+	group.Go(func() error {
+		return stream.ForwardMessagesToAdapter(gCtx, acceptingAdapter{})
+	})
+
+	serverConn, err := testServer.waitForConn(targetId, 5*time.Second)
+	require.NoError(t, err)
+	group.Go(func() error {
+		for i := range messages {
+			if err := serverConn.Conn.Write(gCtx, websocket.MessageText, []byte(fmt.Sprintf(`{"id":"%d"}`, i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	// Every ack is written in its own frame.
+	acked := make(map[string]bool)
+	for range messages {
+		_, message, err := serverConn.Conn.Read(ctx)
+		require.NoError(t, err)
+		var ack struct {
+			Id string `json:"id"`
+		}
+		require.NoError(t, json.Unmarshal(message, &ack))
+		acked[ack.Id] = true
+	}
+	assert.Len(t, acked, messages)
+
+	cancel()
+	assert.ErrorIs(t, group.Wait(), context.Canceled)
+}
+
+// newAckWriterStream connects a stream to the test server, the tests call writeAcks directly.
+func newAckWriterStream(t *testing.T, targetId string) (*ChainWatchStream, *TestWebsocketConn) {
+	stream, err := NewChainWatchStream(context.Background(), Config{
+		URL:            fmt.Sprintf("ws://localhost:%d/targets/%s/websocket", testServerPort, targetId),
+		Mode:           StreamModeAck,
+		WorkerPoolSize: 1,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = stream.conn.CloseNow() })
+
+	serverConn, err := testServer.waitForConn(targetId, 5*time.Second)
+	require.NoError(t, err)
+	return stream, serverConn
+}
+
+// queuedAcks returns a channel of the given capacity holding the acks with the ids from first to last.
+func queuedAcks(capacity, first, last int) chan []byte {
+	acks := make(chan []byte, capacity)
+	for i := first; i <= last; i++ {
+		acks <- []byte(fmt.Sprintf(`{"id":"%d"}`, i))
+	}
+	return acks
+}
+
+func TestWebsocket_writeAcks(t *testing.T) {
+	stream, serverConn := newAckWriterStream(t, "3b8e1f47-0c2d-4a96-b5e3-7d1f9a2c6e84")
+
+	// The acks queued behind the first one are written back to back, each in its own frame.
+	acks := queuedAcks(10, 1, 5)
+	require.NoError(t, stream.writeAcks(context.Background(), []byte(`{"id":"0"}`), acks))
+	assert.Empty(t, acks)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := range 6 {
+		_, message, err := serverConn.Conn.Read(ctx)
+		require.NoError(t, err)
+		assert.JSONEq(t, fmt.Sprintf(`{"id":"%d"}`, i), string(message))
+	}
+}
+
+func TestWebsocket_writeAcksLimit(t *testing.T) {
+	stream, serverConn := newAckWriterStream(t, "5e2a9c13-7f4b-4d08-a6c1-0b3e8f5d2a97")
+
+	acks := queuedAcks(maxCoalescedAcks+10, 1, maxCoalescedAcks+5)
+	require.NoError(t, stream.writeAcks(context.Background(), []byte(`{"id":"0"}`), acks))
+	assert.Len(t, acks, 6, "at most maxCoalescedAcks are written at once")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := range maxCoalescedAcks {
+		_, message, err := serverConn.Conn.Read(ctx)
+		require.NoError(t, err)
+		assert.JSONEq(t, fmt.Sprintf(`{"id":"%d"}`, i), string(message))
+	}
+}
+
+func TestWebsocket_writeAcksFailure(t *testing.T) {
+	stream, serverConn := newAckWriterStream(t, "c7d4b2e9-1a6f-4e35-8b0c-9f2e5a7d3c16")
+	require.NoError(t, stream.conn.CloseNow())
+
+	acks := queuedAcks(10, 1, 2)
+	assert.ErrorContains(t, stream.writeAcks(context.Background(), []byte(`{"id":"0"}`), acks), "use of closed network connection")
+	assert.Len(t, acks, 2, "the acks behind the failed one stay queued")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, _, err := serverConn.Conn.Read(ctx)
+	assert.Error(t, err, "the failed ack is dropped")
+}
+
+// failingAdapter fails the messages containing fail, and the first failures messages containing flaky.
+type failingAdapter struct {
+	sync.Mutex
+	failures int
+	attempts map[string]int
+}
+
+func (a *failingAdapter) HandleMessage(_ context.Context, message []byte) error {
+	a.Lock()
+	defer a.Unlock()
+	a.attempts[string(message)]++
+	if strings.Contains(string(message), "fail") {
+		return errors.New("adapter failed")
+	}
+	if strings.Contains(string(message), "flaky") && a.attempts[string(message)] <= a.failures {
+		return errors.New("adapter failed")
+	}
+	return nil
+}
+
+func TestWebsocket_redelivery(t *testing.T) {
+	const targetId = "d4c1e8b2-3f6a-4e97-a0b5-71c9e2f8d346"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	adapter := &failingAdapter{failures: 2, attempts: make(map[string]int)}
+	stream, err := NewChainWatchStream(context.Background(), Config{
+		URL:            fmt.Sprintf("ws://localhost:%d/targets/%s/websocket", testServerPort, targetId),
+		Mode:           StreamModeAck,
+		WorkerPoolSize: 1,
+		Redelivery: &RedeliveryConfig{
+			Delay:           5 * time.Millisecond,
+			MaxDelay:        10 * time.Millisecond,
+			MaxRedeliveries: 2,
+			OnExhausted:     ExhaustedActionSkip,
+		},
+	})
+	require.NoError(t, err)
+
+	group, gCtx := errgroup.WithContext(ctx)
+	group.Go(func() error {
+		return stream.ForwardMessagesToAdapter(gCtx, adapter)
+	})
+
+	serverConn, err := testServer.waitForConn(targetId, 5*time.Second)
+	require.NoError(t, err)
+
+	// Like Chain Watch in ack mode, the next message is sent only after the previous one was acknowledged. The failing
+	// message is acked when it is skipped, the flaky message after two redeliveries.
+	for _, message := range []string{`{"id":"fail"}`, `{"id":"flaky"}`} {
+		require.NoError(t, serverConn.Conn.Write(ctx, websocket.MessageText, []byte(message)))
+
+		readCtx, readCancel := context.WithTimeout(ctx, 5*time.Second)
+		_, ack, err := serverConn.Conn.Read(readCtx)
+		readCancel()
+		require.NoError(t, err)
+		assert.JSONEq(t, message, string(ack))
+	}
+
+	cancel()
+	assert.ErrorIs(t, group.Wait(), context.Canceled)
+	assert.Equal(t, map[string]int{`{"id":"fail"}`: 3, `{"id":"flaky"}`: 3}, adapter.attempts)
+}
+
+func TestWebsocket_redeliveryExhausted(t *testing.T) {
+	const targetId = "8f2b7c41-6d0e-4a53-b9e8-2c4d1f7a6e95"
+
+	adapter := &failingAdapter{attempts: make(map[string]int)}
+	stream, err := NewChainWatchStream(context.Background(), Config{
+		URL:            fmt.Sprintf("ws://localhost:%d/targets/%s/websocket", testServerPort, targetId),
+		Mode:           StreamModeNoAck,
+		WorkerPoolSize: 1,
+		Redelivery:     &RedeliveryConfig{Delay: time.Millisecond, MaxDelay: time.Millisecond, MaxRedeliveries: 1, OnExhausted: ExhaustedActionStop},
+	})
+	require.NoError(t, err)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- stream.ForwardMessagesToAdapter(context.Background(), adapter)
+	}()
+
+	serverConn, err := testServer.waitForConn(targetId, 5*time.Second)
+	require.NoError(t, err)
+	require.NoError(t, serverConn.Conn.Write(context.Background(), websocket.MessageText, []byte(`{"id":"fail"}`)))
+
+	select {
+	case err := <-result:
+		assert.EqualError(t, err, "message failed after 1 redeliveries: adapter failed")
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream did not stop")
+	}
+}
+
+func TestWebsocket_dialErrorRedactsSecrets(t *testing.T) {
+	logs := logtest.Capture(t)
+
+	// Nothing listens on port 1, so dialing fails without a response.
+	_, err := NewChainWatchStream(context.Background(), Config{
+		URL:            "ws://127.0.0.1:1/targets/0d6c4f5e-2b7a-4c1d-9e8f-3a2b1c0d9e8f/websocket",
+		ApiKey:         "stream-api-key",
+		Headers:        []Header{{Key: "Authorization", Value: "Bearer header-token"}, {Key: "X-Tenant", Value: "tenant"}},
+		WorkerPoolSize: 1,
+	})
+	require.Error(t, err)
+
+	assert.Contains(t, logs.String(), "error dialing websocket")
+	assert.NotContains(t, logs.String(), "stream-api-key")
+	assert.NotContains(t, logs.String(), "header-token")
+	assert.Contains(t, logs.String(), "tenant", "values of other headers are logged")
+}